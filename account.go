@@ -0,0 +1,436 @@
+//    Title: account.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var (
+	ErrBadCredentials = errors.New("Invalid username or password.")
+	ErrNoSession      = errors.New("No valid session.")
+)
+
+// User is the record kept in the users table for each account.
+// User is an account.  TokenGeneration is carried by the user's bearer
+// tokens and raised to revoke every token issued before.
+type User struct {
+	Username        string `json:"username"`
+	Email           string `json:"email"`
+	Passhash        string `json:"passhash"`
+	Salt            string `json:"salt"`
+	Privilege       string `json:"privilege"`
+	Session         string `json:"session"`
+	Verified        bool   `json:"verified,string"`
+	TokenGeneration int64  `json:"token_generation,omitempty"`
+}
+
+type AccountRequest struct {
+	Password    string `json:"password"`
+	Newpassword string `json:"newpassword"`
+	Email       string `json:"email"`
+}
+
+type AccountResponse struct {
+	Action string      `json:"action"`
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Fields FieldErrors `json:"fields,omitempty"`
+	Cookie string      `json:"cookie,omitempty"`
+}
+
+func randomHex() (string, error) {
+	randombytes := make([]byte, 16)
+	if _, err := rand.Read(randombytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(randombytes)), nil
+}
+
+func hashPassword(username string, email string, password string, salt string) string {
+	hashstring := []byte(fmt.Sprintf("%s%s%s%s", username, email, password, salt))
+	return fmt.Sprintf("%x", sha256.Sum256(hashstring))
+}
+
+func (a *App) GetUser(ctx context.Context, username string) (*User, error) {
+	if a.DB == nil {
+		return nil, ErrNoDatabase
+	}
+	user, err := Get[*User](ctx, a.DB, "users", username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, &DecodeError{Table: "users", Key: username, Err: errors.New("Empty user record.")}
+	}
+	return user, nil
+}
+
+// SaveUser merges the user into the stored record, so fields added to the
+// record by the application are kept.
+func (a *App) SaveUser(ctx context.Context, user *User) error {
+	if a.DB == nil {
+		return ErrNoDatabase
+	}
+	_, err := a.DB.PatchObj(ctx, "users", user.Username, user)
+	return err
+}
+
+func (a *App) Authenticate(ctx context.Context, username string, password string) (*User, error) {
+	user, err := a.GetUser(ctx, username)
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	if hashPassword(username, user.Email, password, user.Salt) == user.Passhash {
+		return user, nil
+	}
+	// Accounts registered while clients always hashed passwords hold a hash of
+	// the client's SHA-256 digest.  They are rehashed over the password itself
+	// the first time it is given.
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+	if a.Rules.HashedPasswords || hashPassword(username, user.Email, digest, user.Salt) != user.Passhash {
+		return nil, ErrBadCredentials
+	}
+	user.Passhash = hashPassword(username, user.Email, password, user.Salt)
+	if err := a.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (a *App) SessionCookie(user *User) map[string]string {
+	return map[string]string{
+		"username":  user.Username,
+		"privilege": user.Privilege,
+		"session":   user.Session,
+	}
+}
+
+func (a *App) SessionUser(w http.ResponseWriter, r *http.Request) (*User, error) {
+	cookie := a.ReadCookieHandler(w, r, a.Cookiename)
+	if cookie == nil || cookie["username"] == "" || cookie["username"] == "guest" {
+		return nil, ErrNoSession
+	}
+	user, err := a.GetUser(r.Context(), cookie["username"])
+	if err != nil || user.Session == "" || user.Session != cookie["session"] {
+		return nil, ErrNoSession
+	}
+	return user, nil
+}
+
+// EndSessions closes the sockets of username, other than the connection
+// except.
+func (a *App) EndSessions(username string, except string) {
+	a.connsMu.RLock()
+	defer a.connsMu.RUnlock()
+	for id, c := range a.ConnManager {
+		if c.Username != username || id == except {
+			continue
+		}
+		c.Close()
+	}
+}
+
+func (a *App) rotateSession(user *User) error {
+	session, err := randomHex()
+	if err != nil {
+		return err
+	}
+	user.Session = session
+	return nil
+}
+
+func (a *App) ChangePassword(ctx context.Context, username string, password string, newpassword string, except string) (*User, error) {
+	user, err := a.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	user.Salt = salt
+	user.Passhash = hashPassword(username, user.Email, newpassword, salt)
+	if err := a.rotateSession(user); err != nil {
+		return nil, err
+	}
+	user.TokenGeneration++
+	if err := a.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.EndSessions(username, except)
+	if err := a.deleteAPIKeys(ctx, username); err != nil {
+		log.Println("error revoking API keys: ", err)
+	}
+	a.Emitter.Emit("passwordchanged", username)
+	return user, nil
+}
+
+func (a *App) ChangeEmail(ctx context.Context, username string, password string, email string, except string) (*User, error) {
+	user, err := a.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	oldemail := user.Email
+	user.Email = email
+	user.Verified = false
+	user.Passhash = hashPassword(username, email, password, user.Salt)
+	if err := a.rotateSession(user); err != nil {
+		return nil, err
+	}
+	if err := a.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.EndSessions(username, except)
+	if err := a.SendVerification(user); err != nil {
+		log.Println("error sending verification: ", err)
+	}
+	a.Emitter.Emit("emailchanged", username, oldemail, email)
+	return user, nil
+}
+
+func (a *App) DeleteAccount(ctx context.Context, username string, password string, except string) error {
+	if _, err := a.Authenticate(ctx, username, password); err != nil {
+		return err
+	}
+	if err := a.DB.DeleteObj(ctx, "users", username); err != nil {
+		return err
+	}
+	a.deleteAPIKeys(ctx, username)
+	a.EndSessions(username, except)
+	a.Emitter.Emit("accountdeleted", username)
+	return nil
+}
+
+// confirmed runs change, an account change confirmed by the password of
+// username, as a login attempt from ip.  It fails with ErrLocked while logins
+// to the account or from the address are locked, and a wrong password counts
+// towards their lockout.
+func (a *App) confirmed(ctx context.Context, username string, ip string, change func() error) error {
+	wait, err := a.Limiter.Attempt(ctx, username, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return ErrLocked
+	}
+	err = change()
+	if err == ErrBadCredentials {
+		if err := a.Limiter.Fail(ctx, username, ip); err != nil {
+			log.Println("error recording login attempt: ", err)
+		}
+	} else if err := a.Limiter.Succeed(ctx, username, ip); err != nil {
+		log.Println("error recording login attempt: ", err)
+	}
+	return err
+}
+
+func accountError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNoSession:
+		WriteError(w, 401, err.Error(), nil)
+	case ErrBadCredentials:
+		WriteError(w, 401, err.Error(), FieldErrors{"password": err.Error()})
+	case ErrLocked:
+		WriteError(w, 429, err.Error(), FieldErrors{"password": err.Error()})
+	case ErrNoDatabase:
+		WriteError(w, 503, err.Error(), nil)
+	default:
+		if uerr, ok := err.(*UniqueError); ok {
+			WriteError(w, 409, err.Error(), FieldErrors{uerr.Field: "Already in use."})
+			return
+		}
+		WriteError(w, 500, err.Error(), nil)
+	}
+}
+
+func (a *App) checkAccount(action string, req *AccountRequest) FieldErrors {
+	errs := make(FieldErrors)
+	if req.Password == "" {
+		errs["password"] = "Password is required."
+	}
+	switch action {
+	case "changepassword":
+		a.Rules.CheckPassword(errs, "newpassword", req.Newpassword)
+	case "changeemail":
+		a.Rules.CheckEmail(errs, "email", req.Email)
+	}
+	return errs
+}
+
+func (a *App) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	current, err := a.SessionUser(w, r)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	req := &AccountRequest{Password: r.FormValue("password"), Newpassword: r.FormValue("newpassword")}
+	if errs := a.checkAccount("changepassword", req); len(errs) > 0 {
+		WriteError(w, 400, "Invalid request.", errs)
+		return
+	}
+	var user *User
+	err = a.confirmed(r.Context(), current.Username, a.RemoteAddr(r), func() (err error) {
+		user, err = a.ChangePassword(r.Context(), current.Username, req.Password, req.Newpassword, "")
+		return err
+	})
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	a.SetCookieHandler(w, r, a.Cookiename, a.SessionCookie(user))
+	w.WriteHeader(200)
+}
+
+func (a *App) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	current, err := a.SessionUser(w, r)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	req := &AccountRequest{Password: r.FormValue("password"), Email: r.FormValue("email")}
+	if errs := a.checkAccount("changeemail", req); len(errs) > 0 {
+		WriteError(w, 400, "Invalid request.", errs)
+		return
+	}
+	var user *User
+	err = a.confirmed(r.Context(), current.Username, a.RemoteAddr(r), func() (err error) {
+		user, err = a.ChangeEmail(r.Context(), current.Username, req.Password, req.Email, "")
+		return err
+	})
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	a.SetCookieHandler(w, r, a.Cookiename, a.SessionCookie(user))
+	w.WriteHeader(200)
+}
+
+func (a *App) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	current, err := a.SessionUser(w, r)
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	req := &AccountRequest{Password: r.FormValue("password")}
+	if errs := a.checkAccount("deleteaccount", req); len(errs) > 0 {
+		WriteError(w, 400, "Invalid request.", errs)
+		return
+	}
+	err = a.confirmed(r.Context(), current.Username, a.RemoteAddr(r), func() error {
+		return a.DeleteAccount(r.Context(), current.Username, req.Password, "")
+	})
+	if err != nil {
+		accountError(w, err)
+		return
+	}
+	a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
+		"username":  "guest",
+		"privilege": "user",
+	})
+	w.WriteHeader(200)
+}
+
+func (c *Conn) HandleAccount(msg *Message) error {
+	var (
+		req  AccountRequest
+		user *User
+		err  error
+	)
+	res := &AccountResponse{Action: msg.Event}
+	if c.Username == "" || c.Username == "guest" {
+		err = ErrNoSession
+	} else if err = json.Unmarshal(msg.Payload, &req); err == nil {
+		if res.Fields = c.Application.checkAccount(msg.Event, &req); len(res.Fields) > 0 {
+			err = errors.New("Invalid request.")
+		}
+	}
+	if err == nil {
+		err = c.Application.confirmed(c.Context(), c.Username, c.Addr, func() (err error) {
+			switch msg.Event {
+			case "changepassword":
+				user, err = c.Application.ChangePassword(c.Context(), c.Username, req.Password, req.Newpassword, c.Id)
+			case "changeemail":
+				user, err = c.Application.ChangeEmail(c.Context(), c.Username, req.Password, req.Email, c.Id)
+			case "deleteaccount":
+				err = c.Application.DeleteAccount(c.Context(), c.Username, req.Password, c.Id)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+	} else {
+		res.Status = "ok"
+		if user != nil {
+			c.Session = user.Session
+			encoded, err := c.Application.Scook.Encode(c.Application.Cookiename, c.Application.SessionCookie(user))
+			if err != nil {
+				return err
+			}
+			cookie := &http.Cookie{
+				Name:  c.Application.Cookiename,
+				Value: encoded,
+				Path:  "/",
+			}
+			res.Cookie = cookie.String()
+		} else {
+			c.Username = "guest"
+			c.Session = ""
+			c.Privilege = "user"
+		}
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	response := &Message{
+		RoomLength:    len("root"),
+		Room:          "root",
+		EventLength:   len("account"),
+		Event:         "account",
+		DstLength:     len(c.Id),
+		Dst:           c.Id,
+		SrcLength:     len(c.Id),
+		Src:           c.Id,
+		PayloadLength: len(payload),
+		Payload:       payload,
+	}
+	c.deliver(MessageToBytes(response))
+	return nil
+}
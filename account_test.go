@@ -0,0 +1,167 @@
+//    Title: account_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+// accountApp opens a memory database holding the user jon, whose password
+// is hashed as the client did before hashed_passwords was opt-in when legacy
+// is true.
+func accountApp(t *testing.T, password string, legacy bool) *App {
+	t.Helper()
+	a := NewApp()
+	db, err := a.NewDatabase("memory", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DB = db
+	a.Scook = securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	sent := password
+	if legacy {
+		sent = fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+	}
+	user := &User{Username: "jon", Email: "jon@example.com", Salt: "salt", Privilege: "user", Session: "session"}
+	user.Passhash = hashPassword(user.Username, user.Email, sent, user.Salt)
+	mustStore(t, db.InsertObj(context.Background(), "users", user.Username, user))
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	const password = "Secret password 1"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+	tests := []struct {
+		name     string
+		legacy   bool
+		hashed   bool
+		password string
+		ok       bool
+	}{
+		{"plain", false, false, password, true},
+		{"plain wrong", false, false, "wrong", false},
+		{"legacy account, plain password", true, false, password, true},
+		{"legacy account, wrong password", true, false, "wrong", false},
+		{"legacy account, client hashing", true, true, digest, true},
+		{"legacy account, client hashing, plain password", true, true, password, false},
+		{"unknown user", false, false, password, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := accountApp(t, password, test.legacy)
+			a.Rules.HashedPasswords = test.hashed
+			username := "jon"
+			if test.name == "unknown user" {
+				username = "ann"
+			}
+			_, err := a.Authenticate(context.Background(), username, test.password)
+			if test.ok && err != nil {
+				t.Fatalf("got %v, want a login", err)
+			} else if !test.ok && err != ErrBadCredentials {
+				t.Fatalf("got %v, want ErrBadCredentials", err)
+			}
+		})
+	}
+}
+
+// TestAuthenticateRehashesLegacyAccounts checks that a legacy account is moved
+// to a hash of the password itself on its first login.
+func TestAuthenticateRehashesLegacyAccounts(t *testing.T) {
+	const password = "Secret password 1"
+	ctx := context.Background()
+	a := accountApp(t, password, true)
+	if _, err := a.Authenticate(ctx, "jon", password); err != nil {
+		t.Fatal(err)
+	}
+	user, err := a.GetUser(ctx, "jon")
+	mustStore(t, err)
+	if user.Passhash != hashPassword("jon", user.Email, password, user.Salt) {
+		t.Fatal("the legacy hash was not replaced")
+	}
+	if _, err := a.Authenticate(ctx, "jon", password); err != nil {
+		t.Fatalf("login after the rehash failed: %s", err)
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
+	if _, err := a.Authenticate(ctx, "jon", digest); err != ErrBadCredentials {
+		t.Fatalf("the old digest still logs in: %v", err)
+	}
+}
+
+func TestAccountHandlersWithoutADatabase(t *testing.T) {
+	a := NewApp()
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"register", a.RegisterHandler},
+		{"login", a.LoginHandler},
+	}
+	form := url.Values{"username": {"jon"}, "email": {"jon@example.com"}, "password": {"Secret password 1"}}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/"+test.name, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+		if w.Code != 503 {
+			t.Errorf("%s answered %d without a database, want 503", test.name, w.Code)
+		}
+	}
+}
+
+// TestAccountChangesCountAsLogins checks that the password confirming an
+// account change over the socket is limited like a login.
+func TestAccountChangesCountAsLogins(t *testing.T) {
+	const password = "Secret password 1"
+	bad, locked := ErrBadCredentials.Error(), ErrLocked.Error()
+	tests := []struct {
+		name      string
+		passwords []string
+		want      []string
+	}{
+		{"wrong passwords lock", []string{"wrong", "wrong", "wrong", password}, []string{bad, bad, bad, locked}},
+		{"success clears failures", []string{"wrong", "wrong", password, "wrong", "wrong", password}, []string{bad, bad, "", bad, bad, ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := accountApp(t, password, false)
+			a.Limiter.MaxFailures = 3
+			a.Limiter.BaseDelay = 0
+			a.Limiter.MaxDelay = 0
+			c := &Conn{Application: a, Id: "jon1", Username: "jon", Addr: "192.0.2.1", Send: make(chan []byte, 16)}
+			for i, attempt := range test.passwords {
+				payload, _ := json.Marshal(&AccountRequest{Password: attempt, Email: fmt.Sprintf("jon%d@example.com", i)})
+				msg := &Message{RoomLength: 4, Room: "root", EventLength: 11, Event: "changeemail", PayloadLength: len(payload), Payload: payload}
+				mustStore(t, c.HandleAccount(msg))
+				res := &AccountResponse{}
+				mustStore(t, json.Unmarshal(BytesToMessage(<-c.Send).Payload, res))
+				if res.Error != test.want[i] {
+					t.Fatalf("attempt %d: got %q, want %q", i+1, res.Error, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -17,15 +17,13 @@
 package rtgo
 
 import (
-    "crypto/rand"
-    "crypto/sha1"
-    "crypto/sha256"
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "github.com/chuckpreslar/emission"
     "github.com/gorilla/securecookie"
     "github.com/satori/go.uuid"
-    "github.com/tpjg/goriakpbc"
     "html/template"
     "io/ioutil"
     "log"
@@ -33,6 +31,7 @@ import (
     "regexp"
     "strconv"
     "strings"
+    "sync"
 )
 
 type App struct {
@@ -43,15 +42,42 @@ type App struct {
     Cookiename  string
     Hashkey     string
     Blockkey    string
+    Tokenkey    string
+    Baseurl     string
     Scook       *securecookie.SecureCookie
     Templates   *template.Template
     Emitter     *emission.Emitter
     Handlers    map[string]func(w http.ResponseWriter, r *http.Request)
     Database    map[string]map[string]string
+    Mail        map[string]map[string]string
+    Validation  map[string]string
+    Lockout     map[string]string
+    History     map[string]string
+    Blob        map[string]string
+    Cache       map[string]map[string]string
+    Retention   map[string]map[string]string
+    Access      map[string]map[string]string
     Routes      map[string]map[string]string
+    Feeds       map[string]string
     ConnManager map[string]*Conn
     RoomManager map[string]*Room
     DB          *Database
+    DBs         map[string]*Database
+    Mailer      Mailer
+    Rules       *Rules
+    Limiter     *Limiter
+    Messages    *MessageStore
+    Blobs       BlobStore
+    tokenkey    []byte
+    connsMu     sync.RWMutex
+    blobMax     int64
+    blobChunk   int
+    feeds       map[string]map[string]bool
+    feedsMu     sync.RWMutex
+    roomsMu     sync.RWMutex
+    views       map[string]map[string]*liveView
+    viewing     map[string]*liveView
+    viewsMu     sync.Mutex
 }
 
 func (a *App) ReadCookieHandler(w http.ResponseWriter, r *http.Request, cookname string) map[string]string {
@@ -82,65 +108,117 @@ func (a *App) SetCookieHandler(w http.ResponseWriter, r *http.Request, cookname
 
 func (a *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != "POST" {
-        http.Error(w, "Invalid request method.", 405)
+        WriteError(w, 405, "Invalid request method.", nil)
+        return
+    }
+    if a.DB == nil {
+        WriteError(w, 503, ErrNoDatabase.Error(), nil)
         return
     }
     username := r.FormValue("username")
     email := r.FormValue("email")
     password := r.FormValue("password")
-    if _, err := a.DB.GetObj("users", username); err == nil {
-        w.WriteHeader(500)
+    errs := make(FieldErrors)
+    a.Rules.CheckUsername(errs, username)
+    a.Rules.CheckEmail(errs, "email", email)
+    a.Rules.CheckPassword(errs, "password", password)
+    if len(errs) > 0 {
+        WriteError(w, 400, "Invalid registration.", errs)
         return
     }
-    randombytes := make([]byte, 16)
-    if _, err := rand.Read(randombytes); err != nil {
-        w.WriteHeader(500)
+    if _, err := a.DB.GetObj(r.Context(), "users", username); err == nil {
+        WriteError(w, 409, "User already exists.", FieldErrors{"username": "Username is taken."})
         return
     }
-    salt := fmt.Sprintf("%x", sha1.Sum(randombytes))
-    hashstring := []byte(fmt.Sprintf("%s%s%s%s", username, email, password, salt))
-    passhash := fmt.Sprintf("%x", sha256.Sum256(hashstring))
-    obj := map[string]string{
-        "username":  username,
-        "passhash":  passhash,
-        "email":     email,
-        "salt":      salt,
-        "privilege": "user",
-    }
-    if err := a.DB.InsertObj("users", username, obj); err != nil {
-        w.WriteHeader(500)
+    salt, err := randomHex()
+    if err != nil {
+        WriteError(w, 500, "Could not create user.", nil)
         return
     }
-    a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
-        "username":  username,
-        "privilege": "user",
-    })
+    session, err := randomHex()
+    if err != nil {
+        WriteError(w, 500, "Could not create user.", nil)
+        return
+    }
+    obj := &User{
+        Username:  username,
+        Passhash:  hashPassword(username, email, password, salt),
+        Email:     email,
+        Salt:      salt,
+        Privilege: "user",
+        Session:   session,
+    }
+    if err := a.DB.InsertObj(r.Context(), "users", username, obj); err != nil {
+        if uerr, ok := err.(*UniqueError); ok {
+            WriteError(w, 409, "User already exists.", FieldErrors{uerr.Field: "Already in use."})
+            return
+        }
+        WriteError(w, 500, "Could not create user.", nil)
+        return
+    }
+    if err := a.SendVerification(obj); err != nil {
+        log.Println("error sending verification: ", err)
+    }
+    a.SetCookieHandler(w, r, a.Cookiename, a.SessionCookie(obj))
     w.WriteHeader(200)
 }
 
 func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != "POST" {
-        http.Error(w, "Invalid request method.", 405)
+        WriteError(w, 405, "Invalid request method.", nil)
+        return
+    }
+    if a.DB == nil {
+        WriteError(w, 503, ErrNoDatabase.Error(), nil)
         return
     }
     username := r.FormValue("username")
     password := r.FormValue("password")
-    initial, err := a.DB.GetObj("users", username)
+    errs := make(FieldErrors)
+    if username == "" {
+        errs["username"] = "Username is required."
+    }
+    if password == "" {
+        errs["password"] = "Password is required."
+    }
+    if len(errs) > 0 {
+        WriteError(w, 400, "Invalid login.", errs)
+        return
+    }
+    ip := a.RemoteAddr(r)
+    wait, err := a.Limiter.Attempt(r.Context(), username, ip)
     if err != nil {
-        w.WriteHeader(500)
+        WriteError(w, 500, "Could not check login attempts.", nil)
         return
     }
-    result := initial.(map[string]string)
-    passhash := sha256.Sum256([]byte(fmt.Sprintf("%s%s%s%s", username, result["email"], password, result["salt"])))
-    if fmt.Sprintf("%x", passhash) == result["passhash"] {
-        a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
-            "username":  username,
-            "privilege": result["privilege"],
-        })
-        w.WriteHeader(200)
+    if wait > 0 {
+        seconds := setRetryAfter(w, wait)
+        WriteError(w, 429, ErrLocked.Error(), FieldErrors{"password": fmt.Sprintf("Too many failed attempts, try again in %d seconds.", seconds)})
         return
     }
-    w.WriteHeader(500)
+    user, err := a.Authenticate(r.Context(), username, password)
+    if err != nil {
+        if err := a.Limiter.Fail(r.Context(), username, ip); err != nil {
+            log.Println("error recording login attempt: ", err)
+        }
+        WriteError(w, 401, err.Error(), FieldErrors{"password": err.Error()})
+        return
+    }
+    if err := a.Limiter.Succeed(r.Context(), username, ip); err != nil {
+        log.Println("error recording login attempt: ", err)
+    }
+    if user.Session == "" {
+        if err := a.rotateSession(user); err != nil {
+            WriteError(w, 500, "Could not start session.", nil)
+            return
+        }
+        if err := a.SaveUser(r.Context(), user); err != nil {
+            WriteError(w, 500, "Could not start session.", nil)
+            return
+        }
+    }
+    a.SetCookieHandler(w, r, a.Cookiename, a.SessionCookie(user))
+    w.WriteHeader(200)
 }
 
 func (a *App) BaseHandler(w http.ResponseWriter, r *http.Request) {
@@ -148,10 +226,12 @@ func (a *App) BaseHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Method not allowed", 405)
         return
     }
-    a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
-        "username":  "guest",
-        "privilege": "user",
-    })
+    if _, err := a.SessionUser(w, r); err != nil {
+        a.SetCookieHandler(w, r, a.Cookiename, map[string]string{
+            "username":  "guest",
+            "privilege": "user",
+        })
+    }
     a.Templates.ExecuteTemplate(w, "base", nil)
 }
 
@@ -207,11 +287,28 @@ func (a *App) FindRoute(path string) map[string]string {
 }
 
 func (a *App) NewConnection(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+    var scope *Scope
     cookie := a.ReadCookieHandler(w, r, a.Cookiename)
+    if cookie == nil {
+        cookie = make(map[string]string)
+    }
+    if requestToken(r) != "" {
+        user, tokenscope, err := a.TokenUser(r)
+        if err != nil {
+            WriteError(w, 401, err.Error(), nil)
+            return nil, err
+        }
+        cookie = a.SessionCookie(user)
+        scope = tokenscope
+    } else if _, err := a.SessionUser(w, r); err != nil {
+        cookie["username"] = "guest"
+        cookie["session"] = ""
+    }
     socket, err := upgrader.Upgrade(w, r, nil)
     if err != nil {
         return nil, err
     }
+    ctx, cancel := context.WithCancel(r.Context())
     c := &Conn{
         Application: a,
         Socket:      socket,
@@ -219,12 +316,36 @@ func (a *App) NewConnection(w http.ResponseWriter, r *http.Request) (*Conn, erro
         Send:        make(chan []byte, 256),
         Rooms:       make(map[string]*Room),
         Privilege:   cookie["privilege"],
+        Username:    cookie["username"],
+        Session:     cookie["session"],
+        Scope:       scope,
+        Addr:        a.RemoteAddr(r),
+        ctx:         ctx,
+        cancel:      cancel,
+        closing:     make(chan struct{}),
     }
+    a.connsMu.Lock()
     a.ConnManager[c.Id] = c
+    a.connsMu.Unlock()
     return c, nil
 }
 
+// removeConnection forgets a connection once its ReadPump has ended.
+func (a *App) removeConnection(c *Conn) {
+    a.connsMu.Lock()
+    delete(a.ConnManager, c.Id)
+    a.connsMu.Unlock()
+}
+
 func (a *App) NewRoom(name string) *Room {
+    a.roomsMu.Lock()
+    defer a.roomsMu.Unlock()
+    return a.newRoom(name)
+}
+
+// newRoom starts the room called name and registers it in RoomManager.  The
+// caller holds roomsMu.
+func (a *App) newRoom(name string) *Room {
     r := &Room{
         Application: a,
         Name:        name,
@@ -239,34 +360,127 @@ func (a *App) NewRoom(name string) *Room {
     return r
 }
 
-func (a *App) NewDatabase(name string, params map[string]string) *Database {
-    dsn := ""
-    create := ""
-    switch name {
-    case "riak":
-        dsn = fmt.Sprintf("%s:%s", params["host"], params["port"])
-        create = ""
-    case "postgres":
-        dsn = fmt.Sprintf("dbname=%s user=%s password=%s host=%s sslmode=%s fallback_application_name=%s connect_timeout=%s sslcert=%s sslkey=%s sslrootcert=%s", params["dbname"], params["user"], params["password"], params["host"], params["sslmode"], params["fallback_application_name"], params["connect_timeout"], params["sslcert"], params["sslkey"], params["sslrootcert"])
-        create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BYTEA)"
-    case "mysql":
-        dsn = fmt.Sprintf("%s:%s@%s/%s?allowAllFiles=%s&allowCleartextPasswords=%s&allowOldPasswords=%s&charset=%s&collation=%s&clientFoundRows=%s&loc=%s&parseTime=%s&strict=%s&timeout=%s&tls=%s", params["user"], params["password"], params["host"], params["dbname"], params["allowAllFiles"], params["allowCleartextPasswords"], params["allowOldPasswords"], params["charset"], params["collation"], params["clientFoundRows"], params["loc"], params["parseTime"], params["strict"], params["timeout"], params["tls"])
-        create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data LONGBLOB)"
-    case "sqlite3":
-        dsn = fmt.Sprintf("%s", params["file"])
-        create = "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BLOB)"
+// room returns the room called name, or nil if there is none.  It is safe to
+// call from any goroutine.
+func (a *App) room(name string) *Room {
+    a.roomsMu.RLock()
+    defer a.roomsMu.RUnlock()
+    return a.RoomManager[name]
+}
+
+// openRoom returns the room called name, starting it if there is none.
+func (a *App) openRoom(name string) *Room {
+    a.roomsMu.Lock()
+    defer a.roomsMu.Unlock()
+    if r, ok := a.RoomManager[name]; ok {
+        return r
+    }
+    return a.newRoom(name)
+}
+
+// databaseDriver returns the driver of a configured database: its "driver"
+// setting, or its name for entries named after a driver such as "postgres".
+func databaseDriver(name string, params map[string]string) string {
+    if driver := params["driver"]; driver != "" {
+        return driver
+    }
+    return name
+}
+
+// DefaultDatabase returns the name of the configured database that App.DB
+// points to: the one whose "default" setting is true, or the only one.
+func (a *App) DefaultDatabase() (string, error) {
+    defaults := make([]string, 0)
+    for name, params := range a.Database {
+        if params["default"] == "true" {
+            defaults = append(defaults, name)
+        }
+    }
+    if len(defaults) == 1 {
+        return defaults[0], nil
+    } else if len(defaults) > 1 {
+        return "", errors.New("More than one database is marked as default.")
+    }
+    for name := range a.Database {
+        if len(a.Database) == 1 {
+            return name, nil
+        }
+        return "", errors.New("Several databases are configured; mark one with \"default\": \"true\".")
+    }
+    return "", ErrNoDatabase
+}
+
+// NewDatabase opens a database and adds it to DBs under name.  The first
+// database opened, or one whose "default" setting is true, becomes DB.
+func (a *App) NewDatabase(name string, params map[string]string) (*Database, error) {
+    store, err := NewStore(databaseDriver(name, params))
+    if err != nil {
+        return nil, err
     }
     db := &Database{
         Application: a,
         Name:        name,
-        Buckets:     make(map[string]*riak.Bucket),
+        Driver:      databaseDriver(name, params),
         Params:      params,
-        Dsn:         dsn,
-        Create:      create,
+        Store:       store,
+    }
+    if err := db.Start(); err != nil {
+        return nil, err
+    }
+    a.DBs[name] = db
+    if a.DB == nil || params["default"] == "true" {
+        a.DB = db
+    }
+    return db, nil
+}
+
+// DBNamed returns the database called name, or DB if name is empty.
+func (a *App) DBNamed(name string) (*Database, error) {
+    if name == "" {
+        if a.DB == nil {
+            return nil, ErrNoDatabase
+        }
+        return a.DB, nil
+    }
+    if db, ok := a.DBs[name]; ok {
+        return db, nil
+    }
+    return nil, fmt.Errorf("Unknown database: %s", name)
+}
+
+// TableNamed returns the database and table that name refers to.  Access
+// rules, cache and retention entries and feeds name a table by itself in the
+// default database, or as database.table in any other.
+func (a *App) TableNamed(name string) (*Database, string, error) {
+    dbname, table := "", name
+    if parts := strings.SplitN(name, ".", 2); len(parts) == 2 {
+        dbname, table = parts[0], parts[1]
+    }
+    db, err := a.DBNamed(dbname)
+    if err != nil {
+        return nil, "", err
+    }
+    return db, table, nil
+}
+
+// ReadyHandler answers 200 while every database can be reached and 503 when
+// one cannot, for load balancers and orchestrators to probe.
+func (a *App) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        WriteError(w, 405, "Invalid request method.", nil)
+        return
+    }
+    if len(a.DBs) == 0 {
+        WriteError(w, 503, ErrNoDatabase.Error(), nil)
+        return
+    }
+    for name, db := range a.DBs {
+        if err := db.Health(r.Context()); err != nil {
+            WriteError(w, 503, fmt.Sprintf("%s: %s", name, err), nil)
+            return
+        }
     }
-    db.Start()
-    a.DB = db
-    return db
+    writeJSON(w, map[string]string{"status": "ok"})
 }
 
 func (a *App) Parse(filepath string) {
@@ -292,6 +506,14 @@ func (a *App) Parse(filepath string) {
         blockkey = []byte(a.Blockkey)
     }
     a.Scook = securecookie.New(hashkey, blockkey)
+    if a.Tokenkey != "" {
+        a.tokenkey = []byte(a.Tokenkey)
+    } else {
+        a.tokenkey = deriveKey(hashkey, "bearer")
+    }
+    if a.Rules, err = NewRules(a.Validation); err != nil {
+        log.Fatal("Error parsing validation rules: ", err)
+    }
     a.Templates = template.Must(template.ParseGlob("./static/views/*"))
 }
 
@@ -302,13 +524,75 @@ func (a *App) AddHandler(route string, handler func(w http.ResponseWriter, r *ht
 }
 
 func (a *App) Start() {
+    name, err := a.DefaultDatabase()
+    if err != nil && err != ErrNoDatabase {
+        log.Fatal(err)
+    }
     for dbase, params := range a.Database {
-        a.NewDatabase(dbase, params)
-        break
+        if _, err := a.NewDatabase(dbase, params); err != nil {
+            log.Fatal("Error opening database ", dbase, ": ", err)
+        }
+    }
+    a.DB = a.DBs[name]
+    if err := a.configureCaches(); err != nil {
+        log.Fatal("Error configuring cache: ", err)
+    }
+    if err := a.configureRetention(); err != nil {
+        log.Fatal("Error configuring retention: ", err)
+    }
+    for _, db := range a.DBs {
+        if err := db.StartReaper(); err != nil {
+            log.Fatal(err)
+        }
+    }
+    for room, feeds := range a.Feeds {
+        for _, feed := range splitList(feeds) {
+            a.Subscribe(room, feed)
+        }
+    }
+    if a.DB != nil {
+        if err := a.DB.CreateTable(context.Background(), apikeyTable); err != nil {
+            log.Fatal(err)
+        }
+    }
+    if a.Lockout != nil {
+        if _, err := a.NewLimiter(a.Lockout); err != nil {
+            log.Fatal("Error configuring lockout: ", err)
+        }
+    }
+    if a.History != nil {
+        if _, err := a.NewMessageStore(a.History); err != nil {
+            log.Fatal("Error configuring history: ", err)
+        }
+    }
+    if a.Blob != nil {
+        if _, err := a.NewBlobStore(a.Blob); err != nil {
+            log.Fatal("Error configuring blobs: ", err)
+        }
+    }
+    if len(a.Mail) > 1 {
+        log.Fatal("Only one mailer can be configured.")
+    }
+    for mailer, params := range a.Mail {
+        a.NewMailer(mailer, params)
     }
     http.HandleFunc("/", a.BaseHandler)
     http.HandleFunc("/login", a.LoginHandler)
     http.HandleFunc("/register", a.RegisterHandler)
+    http.HandleFunc("/account/password", a.ChangePasswordHandler)
+    http.HandleFunc("/account/email", a.ChangeEmailHandler)
+    http.HandleFunc("/account/delete", a.DeleteAccountHandler)
+    http.HandleFunc("/verify", a.VerifyHandler)
+    http.HandleFunc("/forgot", a.ForgotHandler)
+    http.HandleFunc("/reset", a.ResetHandler)
+    http.HandleFunc("/validation", a.RulesHandler)
+    http.HandleFunc("/token", a.TokenHandler)
+    http.HandleFunc("/apikeys", a.APIKeysHandler)
+    http.HandleFunc("/objects/", a.ObjectHandler)
+    http.HandleFunc("/history", a.HistoryHandler)
+    http.HandleFunc("/blobs/", a.BlobHandler)
+    http.HandleFunc("/cache", a.CacheHandler)
+    http.HandleFunc("/ready", a.ReadyHandler)
     http.HandleFunc("/ws", a.SocketHandler)
     http.HandleFunc("/static/", a.StaticHandler)
     for route, handler := range a.Handlers {
@@ -322,11 +606,24 @@ func (a *App) Start() {
 }
 
 func NewApp() *App {
+    rules, err := NewRules(nil)
+    if err != nil {
+        panic(err)
+    }
     app := &App{
         Emitter:     emission.NewEmitter(),
         Handlers:    make(map[string]func(w http.ResponseWriter, r *http.Request)),
         ConnManager: make(map[string]*Conn),
+        DBs:         make(map[string]*Database),
+        feeds:       make(map[string]map[string]bool),
+        views:       make(map[string]map[string]*liveView),
+        viewing:     make(map[string]*liveView),
         RoomManager: make(map[string]*Room),
+        Rules:       rules,
+    }
+    if _, err := app.NewLimiter(nil); err != nil {
+        panic(err)
     }
+    app.tokenkey = securecookie.GenerateRandomKey(32)
     return app
 }
@@ -0,0 +1,417 @@
+//    Title: auth.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	apikeyTable    = "apikeys"
+	bearerTokenAge = time.Hour
+	maxBearerAge   = 24 * time.Hour
+)
+
+var ErrBadAPIKey = errors.New("Invalid API key or token.")
+
+// An empty list of rooms or events allows all of them.
+type Scope struct {
+	Rooms  []string `json:"rooms,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+type APIKey struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Hash     string `json:"hash,omitempty"`
+	Created  int64  `json:"created"`
+	Scope    *Scope `json:"scope"`
+}
+
+type Claims struct {
+	Subject    string `json:"sub"`
+	Session    string `json:"sid"`
+	Generation int64  `json:"gen,omitempty"`
+	Issued     int64  `json:"iat"`
+	Expires    int64  `json:"exp"`
+	Scope      *Scope `json:"scope,omitempty"`
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scope) Allows(room string, event string) bool {
+	if s == nil {
+		return true
+	}
+	if room != "root" && !matchAny(s.Rooms, room) {
+		return false
+	}
+	switch event {
+	case "join", "leave", "joined", "left":
+		return true
+	}
+	return matchAny(s.Events, event)
+}
+
+// Narrow returns the scope allowed by both s and the requested scope.  A
+// list narrowed to nothing holds a single empty pattern, which matches no
+// room or event.
+func (s *Scope) Narrow(requested *Scope) *Scope {
+	if requested == nil {
+		return s
+	}
+	if s == nil {
+		return requested
+	}
+	narrowed := &Scope{}
+	for _, pair := range []struct {
+		have []string
+		want []string
+		dest *[]string
+	}{
+		{s.Rooms, requested.Rooms, &narrowed.Rooms},
+		{s.Events, requested.Events, &narrowed.Events},
+	} {
+		if len(pair.want) == 0 {
+			*pair.dest = pair.have
+			continue
+		}
+		for _, name := range pair.want {
+			if matchAny(pair.have, name) {
+				*pair.dest = append(*pair.dest, name)
+			}
+		}
+		if len(*pair.dest) == 0 {
+			*pair.dest = []string{""}
+		}
+	}
+	return narrowed
+}
+
+func scopeFromRequest(r *http.Request) *Scope {
+	rooms := splitList(r.FormValue("rooms"))
+	events := splitList(r.FormValue("events"))
+	if len(rooms) == 0 && len(events) == 0 {
+		return nil
+	}
+	return &Scope{Rooms: rooms, Events: events}
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// deriveKey derives a key for label from secret, so that one configured
+// secret does not sign two kinds of credential: HKDF-Expand of a single
+// block, with secret used as the pseudorandom key.
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rtgo " + label))
+	mac.Write([]byte{1})
+	return mac.Sum(nil)
+}
+
+func (a *App) sign(data string) string {
+	mac := hmac.New(sha256.New, a.tokenkey)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *App) NewBearerToken(user *User, scope *Scope, age time.Duration) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		Subject:    user.Username,
+		Session:    user.Session,
+		Generation: user.TokenGeneration,
+		Issued:     now.Unix(),
+		Expires:    now.Add(age).Unix(),
+		Scope:      scope,
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(body)
+	return unsigned + "." + a.sign(unsigned), claims, nil
+}
+
+func (a *App) ReadBearerToken(ctx context.Context, token string) (*User, *Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, ErrBadAPIKey
+	}
+	if !hmac.Equal([]byte(a.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, nil, ErrBadAPIKey
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrBadAPIKey
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(body, claims); err != nil {
+		return nil, nil, ErrBadAPIKey
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, nil, ErrBadAPIKey
+	}
+	user, err := a.GetUser(ctx, claims.Subject)
+	if err != nil || user.Session != claims.Session || user.TokenGeneration != claims.Generation {
+		return nil, nil, ErrBadAPIKey
+	}
+	return user, claims, nil
+}
+
+func (a *App) NewAPIKey(ctx context.Context, username string, name string, scope *Scope) (string, *APIKey, error) {
+	id, err := randomHex()
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex()
+	if err != nil {
+		return "", nil, err
+	}
+	key := &APIKey{
+		Id:       id[:16],
+		Name:     name,
+		Username: username,
+		Hash:     fmt.Sprintf("%x", sha256.Sum256([]byte(secret))),
+		Created:  time.Now().Unix(),
+		Scope:    scope,
+	}
+	if err := a.DB.InsertObj(ctx, apikeyTable, key.Id, key); err != nil {
+		return "", nil, err
+	}
+	a.Emitter.Emit("apikeycreated", username, key.Id)
+	return key.Id + "." + secret, key, nil
+}
+
+func (a *App) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	return Get[*APIKey](ctx, a.DB, apikeyTable, id)
+}
+
+func (a *App) APIKeys(ctx context.Context, username string) ([]*APIKey, error) {
+	keys, err := Find[*APIKey](ctx, a.DB, apikeyTable, "username", username)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		key.Hash = ""
+	}
+	return keys, nil
+}
+
+func (a *App) DeleteAPIKey(ctx context.Context, username string, id string) error {
+	key, err := a.GetAPIKey(ctx, id)
+	if err != nil || key.Username != username {
+		return ErrBadAPIKey
+	}
+	if err := a.DB.DeleteObj(ctx, apikeyTable, id); err != nil {
+		return err
+	}
+	a.Emitter.Emit("apikeydeleted", username, id)
+	return nil
+}
+
+// deleteAPIKeys revokes every API key of username.
+func (a *App) deleteAPIKeys(ctx context.Context, username string) error {
+	keys, err := a.APIKeys(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := a.DB.DeleteObj(ctx, apikeyTable, key.Id); err != nil {
+			return err
+		}
+		a.Emitter.Emit("apikeydeleted", username, key.Id)
+	}
+	return nil
+}
+
+// RevokeTokens revokes every API key and bearer token of username, leaving
+// its browser sessions alone.
+func (a *App) RevokeTokens(ctx context.Context, username string) error {
+	user, err := a.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	user.TokenGeneration++
+	if err := a.SaveUser(ctx, user); err != nil {
+		return err
+	}
+	return a.deleteAPIKeys(ctx, username)
+}
+
+func (a *App) ReadAPIKey(ctx context.Context, apikey string) (*User, *APIKey, error) {
+	parts := strings.SplitN(apikey, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrBadAPIKey
+	}
+	key, err := a.GetAPIKey(ctx, parts[0])
+	if err != nil {
+		return nil, nil, ErrBadAPIKey
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(parts[1])))
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+		return nil, nil, ErrBadAPIKey
+	}
+	user, err := a.GetUser(ctx, key.Username)
+	if err != nil {
+		return nil, nil, ErrBadAPIKey
+	}
+	return user, key, nil
+}
+
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// TokenUser authenticates a request carrying either an API key or a bearer
+// token.  API keys have a single dot and bearer tokens have two.
+func (a *App) TokenUser(r *http.Request) (*User, *Scope, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, nil, ErrNoSession
+	}
+	if strings.Count(token, ".") == 2 {
+		user, claims, err := a.ReadBearerToken(r.Context(), token)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, claims.Scope, nil
+	}
+	user, key, err := a.ReadAPIKey(r.Context(), token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, key.Scope, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		WriteError(w, 500, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (a *App) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  *User
+		scope *Scope
+		err   error
+	)
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	if requestToken(r) != "" {
+		user, scope, err = a.TokenUser(r)
+	} else {
+		user, err = a.SessionUser(w, r)
+	}
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	age := bearerTokenAge
+	if ttl := r.FormValue("ttl"); ttl != "" {
+		if age, err = time.ParseDuration(ttl); err != nil || age <= 0 || age > maxBearerAge {
+			WriteError(w, 400, "Invalid request.", FieldErrors{"ttl": fmt.Sprintf("TTL must be a duration up to %s.", maxBearerAge)})
+			return
+		}
+	}
+	token, claims, err := a.NewBearerToken(user, scope.Narrow(scopeFromRequest(r)), age)
+	if err != nil {
+		WriteError(w, 500, err.Error(), nil)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"token":   token,
+		"expires": claims.Expires,
+		"scope":   claims.Scope,
+	})
+}
+
+func (a *App) APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.SessionUser(w, r)
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		keys, err := a.APIKeys(r.Context(), user.Username)
+		if err != nil {
+			WriteError(w, 500, err.Error(), nil)
+			return
+		}
+		writeJSON(w, keys)
+	case "POST":
+		apikey, key, err := a.NewAPIKey(r.Context(), user.Username, r.FormValue("name"), scopeFromRequest(r))
+		if err != nil {
+			WriteError(w, 500, err.Error(), nil)
+			return
+		}
+		key.Hash = ""
+		writeJSON(w, map[string]interface{}{
+			"key":    apikey,
+			"apikey": key,
+		})
+	case "DELETE":
+		if err := a.DeleteAPIKey(r.Context(), user.Username, r.FormValue("id")); err != nil {
+			WriteError(w, 404, err.Error(), nil)
+			return
+		}
+		w.WriteHeader(200)
+	default:
+		WriteError(w, 405, "Invalid request method.", nil)
+	}
+}
@@ -0,0 +1,120 @@
+//    Title: auth_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const authPassword = "Secret password 1"
+
+// authApp opens the account app of accountApp with an API key table.
+func authApp(t *testing.T) *App {
+	t.Helper()
+	a := accountApp(t, authPassword, false)
+	mustStore(t, a.DB.CreateTable(context.Background(), apikeyTable))
+	return a
+}
+
+func TestBearerTokens(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		age   time.Duration
+		token func(token string) string
+		ok    bool
+	}{
+		{"valid", time.Hour, func(token string) string { return token }, true},
+		{"expired", -time.Second, func(token string) string { return token }, false},
+		{"tampered", time.Hour, func(token string) string { return token[:len(token)-2] + "xx" }, false},
+		{"unsigned", time.Hour, func(token string) string { return token[:strings.LastIndex(token, ".")+1] }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := authApp(t)
+			user, err := a.GetUser(ctx, "jon")
+			mustStore(t, err)
+			token, _, err := a.NewBearerToken(user, &Scope{Rooms: []string{"chat"}}, test.age)
+			mustStore(t, err)
+			got, claims, err := a.ReadBearerToken(ctx, test.token(token))
+			if !test.ok {
+				expectErr(t, err, ErrBadAPIKey)
+				return
+			}
+			mustStore(t, err)
+			if got.Username != "jon" || !claims.Scope.Allows("chat", "say") || claims.Scope.Allows("lobby", "say") {
+				t.Fatalf("token for %s with scope %+v", got.Username, claims.Scope)
+			}
+		})
+	}
+}
+
+// TestCredentialsRevoked checks which account changes revoke the API keys
+// and bearer tokens issued before them.
+func TestCredentialsRevoked(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		change  func(t *testing.T, a *App)
+		keys    bool
+		tokens  bool
+		session bool
+	}{
+		{"nothing", func(t *testing.T, a *App) {}, true, true, true},
+		{"password change", func(t *testing.T, a *App) {
+			_, err := a.ChangePassword(ctx, "jon", authPassword, "Another password 2", "")
+			mustStore(t, err)
+		}, false, false, false},
+		{"password reset", func(t *testing.T, a *App) {
+			user, err := a.GetUser(ctx, "jon")
+			mustStore(t, err)
+			token, err := a.NewToken("reset", "jon", user.Salt, time.Hour)
+			mustStore(t, err)
+			_, err = a.ResetPassword(ctx, token, "Another password 2")
+			mustStore(t, err)
+		}, false, false, false},
+		{"revoke tokens", func(t *testing.T, a *App) {
+			mustStore(t, a.RevokeTokens(ctx, "jon"))
+		}, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := authApp(t)
+			key, _, err := a.NewAPIKey(ctx, "jon", "bot", nil)
+			mustStore(t, err)
+			user, err := a.GetUser(ctx, "jon")
+			mustStore(t, err)
+			token, _, err := a.NewBearerToken(user, nil, time.Hour)
+			mustStore(t, err)
+			test.change(t, a)
+			if _, _, err := a.ReadAPIKey(ctx, key); (err == nil) != test.keys {
+				t.Errorf("API key: got %v, want it to work: %v", err, test.keys)
+			}
+			if _, _, err := a.ReadBearerToken(ctx, token); (err == nil) != test.tokens {
+				t.Errorf("bearer token: got %v, want it to work: %v", err, test.tokens)
+			}
+			user, err = a.GetUser(ctx, "jon")
+			mustStore(t, err)
+			if (user.Session == "session") != test.session {
+				t.Errorf("session kept: %v, want %v", user.Session == "session", test.session)
+			}
+		})
+	}
+}
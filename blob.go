@@ -0,0 +1,822 @@
+//    Title: blob.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBlobMaxSize   = 10 * 1024 * 1024
+	defaultBlobChunkSize = 256 * 1024
+	// blobAccess names the access rules that guard blobs.
+	blobAccess = "blobs"
+)
+
+var (
+	ErrBlobTooLarge = errors.New("Blob is too large.")
+	ErrBlobHash     = errors.New("Blob does not match its hash.")
+	ErrBlobKey      = errors.New("Invalid blob key.")
+	ErrBlobPolicy   = errors.New("Blob tables cannot expire or soft delete.")
+	blobKeyPattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+)
+
+// BlobInfo describes a stored blob.  Hash is the hex SHA-256 of its content
+// and Created is in milliseconds since the epoch.  Owner is the user who first
+// stored it, or empty for a guest.
+type BlobInfo struct {
+	Key         string `json:"key"`
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"type,omitempty"`
+	Created     int64  `json:"created"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// BlobStore keeps binary content by key.  Put streams content from r and
+// fails with ErrBlobTooLarge past the store's size limit, or with ErrBlobHash
+// if info holds a Hash the content does not match, storing nothing in either
+// case.  A blob being replaced stays readable until the new one is complete.
+// Get streams content back; the caller closes the reader.
+type BlobStore interface {
+	Put(ctx context.Context, info *BlobInfo, r io.Reader) (*BlobInfo, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error)
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidBlobKey reports whether key can name a blob: slash separated parts of
+// letters, digits, dots, underscores and dashes, other than . and .., at most
+// 200 characters.
+func ValidBlobKey(key string) bool {
+	if len(key) > 200 || !blobKeyPattern.MatchString(key) {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// blobReader hashes and counts the content read through it, failing once
+// more than max bytes have been read.
+type blobReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+	max    int64
+}
+
+func newBlobReader(r io.Reader, max int64) *blobReader {
+	return &blobReader{reader: r, hash: sha256.New(), max: max}
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.size += int64(n)
+	b.hash.Write(p[:n])
+	if b.max > 0 && b.size > b.max {
+		return n, ErrBlobTooLarge
+	}
+	return n, err
+}
+
+// finish completes info from what was read, checking it against the hash
+// the client gave.
+func (b *blobReader) finish(info *BlobInfo) (*BlobInfo, error) {
+	sum := hex.EncodeToString(b.hash.Sum(nil))
+	if info.Hash != "" && !strings.EqualFold(info.Hash, sum) {
+		return nil, ErrBlobHash
+	}
+	return &BlobInfo{
+		Key:         info.Key,
+		Hash:        sum,
+		Size:        b.size,
+		ContentType: info.ContentType,
+		Created:     unixMillis(time.Now()),
+		Owner:       info.Owner,
+	}, nil
+}
+
+// FileBlobStore keeps each blob as a file under Dir, named by the SHA-256 of
+// its key, next to a JSON file holding its BlobInfo.
+type FileBlobStore struct {
+	Dir     string
+	MaxSize int64
+}
+
+type fileBlob struct {
+	BlobInfo
+	File string `json:"file"`
+}
+
+func (s *FileBlobStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.Dir, name[:2], name)
+}
+
+func (s *FileBlobStore) stat(key string) (*fileBlob, error) {
+	if !ValidBlobKey(key) {
+		return nil, ErrBlobKey
+	}
+	blob, err := ioutil.ReadFile(s.path(key) + ".json")
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	meta := &fileBlob{}
+	if err := json.Unmarshal(blob, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Put writes the content to a temporary file and renames it into place once
+// it is complete, then replaces the JSON file the same way, so readers see
+// either the old blob or the new one.
+func (s *FileBlobStore) Put(ctx context.Context, info *BlobInfo, r io.Reader) (*BlobInfo, error) {
+	if !ValidBlobKey(info.Key) {
+		return nil, ErrBlobKey
+	}
+	base := s.path(info.Key)
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return nil, err
+	}
+	old, _ := s.stat(info.Key)
+	tmp, err := ioutil.TempFile(filepath.Dir(base), ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	reader := newBlobReader(r, s.MaxSize)
+	_, err = io.Copy(tmp, &contextReader{ctx: ctx, reader: reader})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored, err := reader.finish(info)
+	if err != nil {
+		return nil, err
+	}
+	meta := &fileBlob{BlobInfo: *stored, File: filepath.Base(base) + "-" + uuid.NewV4().String()}
+	if err := os.Rename(tmp.Name(), filepath.Join(filepath.Dir(base), meta.File)); err != nil {
+		return nil, err
+	}
+	blob, err := json.Marshal(meta)
+	if err == nil {
+		err = ioutil.WriteFile(base+".json.tmp", blob, 0644)
+	}
+	if err == nil {
+		err = os.Rename(base+".json.tmp", base+".json")
+	}
+	if err != nil {
+		os.Remove(filepath.Join(filepath.Dir(base), meta.File))
+		return nil, err
+	}
+	if old != nil {
+		os.Remove(filepath.Join(filepath.Dir(base), old.File))
+	}
+	return stored, nil
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	meta, err := s.stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filepath.Join(filepath.Dir(s.path(key)), meta.File))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return file, &meta.BlobInfo, nil
+}
+
+func (s *FileBlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	meta, err := s.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &meta.BlobInfo, nil
+}
+
+func (s *FileBlobStore) Delete(ctx context.Context, key string) error {
+	meta, err := s.stat(key)
+	if err != nil {
+		return err
+	}
+	base := s.path(key)
+	if err := os.Remove(base + ".json"); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(filepath.Dir(base), meta.File))
+}
+
+// contextReader stops reading once ctx is done, so an abandoned upload does
+// not keep writing.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// DBBlobStore keeps blobs in a table of a Database, split into chunks of
+// ChunkSize bytes so that no single object gets large and reads can stream.
+// The blob's info is stored under its key in Table and each chunk in the
+// table named by chunkTable under the key, the upload it belongs to and its
+// number, so a blob being replaced keeps its old chunks until the new ones
+// are all written.  Chunks are read and written through the Store itself:
+// they are not objects anyone follows, so they publish no changes and stay
+// out of the cache.  Neither table may have a TTL or soft delete, which would
+// leave a blob's info and its chunks out of step.
+type DBBlobStore struct {
+	DB        *Database
+	Table     string
+	MaxSize   int64
+	ChunkSize int
+}
+
+// dbBlob is the stored info of a blob.  ChunkTable is empty for blobs
+// written before chunks had a table of their own, whose chunks are still in
+// the blob table.
+type dbBlob struct {
+	BlobInfo
+	Upload     string `json:"upload"`
+	Chunks     int    `json:"chunks"`
+	ChunkTable string `json:"chunk_table,omitempty"`
+}
+
+type dbBlobChunk struct {
+	Data []byte `json:"data"`
+}
+
+func chunkKey(key string, upload string, n int) string {
+	return key + "#" + upload + "/" + strconv.Itoa(n)
+}
+
+// chunkTable is the table the chunks of the blobs in table are kept in.
+func chunkTable(table string) string {
+	return table + "_chunks"
+}
+
+// chunks is the table the chunks of meta are kept in.
+func (s *DBBlobStore) chunks(meta *dbBlob) string {
+	if meta.ChunkTable == "" {
+		return s.Table
+	}
+	return meta.ChunkTable
+}
+
+func (s *DBBlobStore) stat(ctx context.Context, key string) (*dbBlob, error) {
+	if !ValidBlobKey(key) {
+		return nil, ErrBlobKey
+	}
+	return Get[*dbBlob](ctx, s.DB, s.Table, key)
+}
+
+func (s *DBBlobStore) putChunk(ctx context.Context, table string, key string, data []byte) error {
+	blob, err := json.Marshal(&dbBlobChunk{Data: data})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.DB.context(ctx)
+	defer cancel()
+	return s.DB.Store.Insert(ctx, table, key, blob)
+}
+
+func (s *DBBlobStore) chunk(ctx context.Context, table string, key string) ([]byte, error) {
+	ctx, cancel := s.DB.context(ctx)
+	defer cancel()
+	record, err := s.DB.Store.Get(ctx, table, key)
+	if err != nil {
+		return nil, err
+	}
+	chunk := &dbBlobChunk{}
+	if err := json.Unmarshal(record.Data, chunk); err != nil {
+		return nil, err
+	}
+	return chunk.Data, nil
+}
+
+func (s *DBBlobStore) deleteChunks(ctx context.Context, meta *dbBlob) {
+	ctx, cancel := s.DB.context(ctx)
+	defer cancel()
+	for n := 0; n < meta.Chunks; n++ {
+		s.DB.Store.Delete(ctx, s.chunks(meta), chunkKey(meta.Key, meta.Upload, n), 0)
+	}
+}
+
+func (s *DBBlobStore) Put(ctx context.Context, info *BlobInfo, r io.Reader) (*BlobInfo, error) {
+	if !ValidBlobKey(info.Key) {
+		return nil, ErrBlobKey
+	}
+	old, err := s.stat(ctx, info.Key)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	meta := &dbBlob{BlobInfo: BlobInfo{Key: info.Key}, Upload: uuid.NewV4().String(), ChunkTable: chunkTable(s.Table)}
+	reader := newBlobReader(r, s.MaxSize)
+	buf := make([]byte, s.ChunkSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if err := s.putChunk(ctx, meta.ChunkTable, chunkKey(info.Key, meta.Upload, meta.Chunks), buf[:n]); err != nil {
+				s.deleteChunks(ctx, meta)
+				return nil, err
+			}
+			meta.Chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			s.deleteChunks(ctx, meta)
+			return nil, err
+		}
+	}
+	stored, err := reader.finish(info)
+	if err == nil {
+		meta.BlobInfo = *stored
+		err = s.DB.UpsertObj(ctx, s.Table, info.Key, meta)
+	}
+	if err != nil {
+		s.deleteChunks(ctx, meta)
+		return nil, err
+	}
+	if old != nil {
+		s.deleteChunks(ctx, old)
+	}
+	return stored, nil
+}
+
+// dbBlobReader reads the chunks of a blob one at a time.
+type dbBlobReader struct {
+	ctx   context.Context
+	store *DBBlobStore
+	meta  *dbBlob
+	next  int
+	buf   []byte
+}
+
+func (b *dbBlobReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.next == b.meta.Chunks {
+			return 0, io.EOF
+		}
+		data, err := b.store.chunk(b.ctx, b.store.chunks(b.meta), chunkKey(b.meta.Key, b.meta.Upload, b.next))
+		if err != nil {
+			return 0, err
+		}
+		b.buf = data
+		b.next++
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *dbBlobReader) Close() error {
+	return nil
+}
+
+func (s *DBBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	meta, err := s.stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &dbBlobReader{ctx: ctx, store: s, meta: meta}, &meta.BlobInfo, nil
+}
+
+func (s *DBBlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	meta, err := s.stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &meta.BlobInfo, nil
+}
+
+func (s *DBBlobStore) Delete(ctx context.Context, key string) error {
+	meta, err := s.stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.DeleteObj(ctx, s.Table, key); err != nil {
+		return err
+	}
+	s.deleteChunks(ctx, meta)
+	return nil
+}
+
+// NewBlobStore sets up the blob store described by the blob section of
+// config.json and makes it the app's Blobs.
+func (a *App) NewBlobStore(params map[string]string) (BlobStore, error) {
+	maxSize := int64(defaultBlobMaxSize)
+	if val, ok := params["max_size"]; ok {
+		num, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || num <= 0 {
+			return nil, fmt.Errorf("Invalid blob value for max_size: %s", val)
+		}
+		maxSize = num
+	}
+	a.blobMax = maxSize
+	a.blobChunk = defaultBlobChunkSize
+	if val, ok := params["chunk_size"]; ok {
+		num, err := strconv.Atoi(val)
+		if err != nil || num <= 0 {
+			return nil, fmt.Errorf("Invalid blob value for chunk_size: %s", val)
+		}
+		a.blobChunk = num
+	}
+	var store BlobStore
+	switch params["store"] {
+	case "", "file":
+		dir := params["dir"]
+		if dir == "" {
+			dir = "blobs"
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		store = &FileBlobStore{Dir: dir, MaxSize: maxSize}
+	case "database":
+		db, err := a.DBNamed(params["database"])
+		if err != nil {
+			return nil, err
+		}
+		table := params["table"]
+		if table == "" {
+			table = "blobs"
+		}
+		if err := db.holdBlobs(table); err != nil {
+			return nil, err
+		}
+		for _, name := range []string{table, chunkTable(table)} {
+			if err := db.CreateTable(context.Background(), name); err != nil {
+				return nil, err
+			}
+		}
+		store = &DBBlobStore{DB: db, Table: table, MaxSize: maxSize, ChunkSize: a.blobChunk}
+	default:
+		return nil, fmt.Errorf("Unknown blob store: %s", params["store"])
+	}
+	a.Blobs = store
+	return store, nil
+}
+
+// holdBlobs marks table and its chunk table as holding blobs, which
+// SetTablePolicy then refuses to expire or soft delete.  It fails with
+// ErrBlobPolicy if either already has such a policy.
+func (db *Database) holdBlobs(table string) error {
+	if db.tables == nil {
+		db.tables = newTableSet()
+	}
+	db.tables.mu.Lock()
+	defer db.tables.mu.Unlock()
+	for _, name := range []string{table, chunkTable(table)} {
+		if policy := db.tables.policies[name]; policy != nil && (policy.TTL > 0 || policy.SoftDelete) {
+			return ErrBlobPolicy
+		}
+	}
+	for _, name := range []string{table, chunkTable(table)} {
+		db.tables.blobs[name] = true
+	}
+	return nil
+}
+
+func blobStatus(err error) int {
+	switch err {
+	case ErrBlobTooLarge:
+		return 413
+	case ErrBlobHash, ErrBlobKey:
+		return 400
+	}
+	return objectStatus(err)
+}
+
+// blobOwner checks that user may replace or delete the blob of key and
+// returns the owner to store with its new content.  A blob keeps the owner
+// that first stored it.  Only that user, or one with admin access to blobs,
+// may replace or delete it.  Blobs stored by guests have no owner.
+func (a *App) blobOwner(ctx context.Context, key string, user *User) (string, error) {
+	owner := user.Username
+	if owner == "guest" {
+		owner = ""
+	}
+	info, err := a.Blobs.Stat(ctx, key)
+	if err == ErrNotFound {
+		return owner, nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Owner == "" {
+		return owner, nil
+	}
+	if info.Owner != owner && !a.CanAccess(blobAccess, "admin", user) {
+		return "", ErrForbidden
+	}
+	return info.Owner, nil
+}
+
+// BlobHandler serves /blobs/<key>.  GET streams the blob with its hash as the
+// ETag, PUT stores the request body, taking the type from Content-Type and
+// checking the body against X-Blob-Hash if given, and DELETE removes it.
+// Replacing or deleting a blob is left to its owner.
+func (a *App) BlobHandler(w http.ResponseWriter, r *http.Request) {
+	var action, op string
+	key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	switch r.Method {
+	case "GET", "HEAD":
+		action, op = "getblob", "read"
+	case "PUT":
+		action, op = "putblob", "write"
+	case "DELETE":
+		action, op = "deleteblob", "write"
+	default:
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	if a.Blobs == nil {
+		WriteError(w, 404, ErrNotFound.Error(), nil)
+		return
+	}
+	user, scope, err := a.RequestUser(w, r)
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	if !scope.Allows("root", action) || !a.CanAccess(blobAccess, op, user) {
+		WriteError(w, 403, ErrForbidden.Error(), nil)
+		return
+	}
+	switch action {
+	case "getblob":
+		info, err := a.Blobs.Stat(r.Context(), key)
+		if err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		tag := `"` + info.Hash + `"`
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(304)
+			return
+		}
+		content, info, err := a.Blobs.Get(r.Context(), key)
+		if err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		defer content.Close()
+		contentType := info.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("ETag", `"`+info.Hash+`"`)
+		if r.Method == "GET" {
+			io.Copy(w, content)
+		}
+	case "putblob":
+		owner, err := a.blobOwner(r.Context(), key, user)
+		if err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		info := &BlobInfo{Key: key, ContentType: r.Header.Get("Content-Type"), Hash: r.Header.Get("X-Blob-Hash"), Owner: owner}
+		stored, err := a.Blobs.Put(r.Context(), info, r.Body)
+		if err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		w.Header().Set("ETag", `"`+stored.Hash+`"`)
+		writeJSON(w, stored)
+	case "deleteblob":
+		if _, err := a.blobOwner(r.Context(), key, user); err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		if err := a.Blobs.Delete(r.Context(), key); err != nil {
+			WriteError(w, blobStatus(err), err.Error(), nil)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
+	}
+}
+
+// maxBlobUploads is how many socket uploads a connection may have open.
+const maxBlobUploads = 4
+
+// BlobRequest is the JSON payload of the blobstart, blobend and blobabort
+// socket events.  Size, if given, lets an upload that is too large fail
+// before any of it is sent.
+type BlobRequest struct {
+	Id          string `json:"id,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"type,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+}
+
+// BlobResponse is the payload of the blob event sent back for each step of a
+// socket upload.  ChunkSize is the largest chunk the client should send.
+type BlobResponse struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Id        string    `json:"id,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	ChunkSize int       `json:"chunk_size,omitempty"`
+	Blob      *BlobInfo `json:"blob,omitempty"`
+}
+
+// blobUpload is a socket upload in progress.  Chunks are written to a pipe
+// that the blob store's Put reads from, so they are stored as they arrive.
+type blobUpload struct {
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+	done   chan blobResult
+}
+
+type blobResult struct {
+	info *BlobInfo
+	err  error
+}
+
+// abort stops the upload and waits for the store to give up on it.
+func (u *blobUpload) abort() {
+	u.cancel()
+	u.writer.CloseWithError(context.Canceled)
+	<-u.done
+}
+
+// startBlob begins an upload, storing the content in the background as the
+// chunks come in, and returns its id.
+func (c *Conn) startBlob(req *BlobRequest) (string, error) {
+	a := c.Application
+	if a.Blobs == nil {
+		return "", ErrNotFound
+	}
+	user := &User{Username: c.Username, Privilege: c.Privilege}
+	if !c.Scope.Allows("root", "putblob") || !a.CanAccess(blobAccess, "write", user) {
+		return "", ErrForbidden
+	}
+	if !ValidBlobKey(req.Key) {
+		return "", ErrBlobKey
+	}
+	owner, err := a.blobOwner(c.Context(), req.Key, user)
+	if err != nil {
+		return "", err
+	}
+	if a.blobMax > 0 && req.Size > a.blobMax {
+		return "", ErrBlobTooLarge
+	}
+	if len(c.uploads) >= maxBlobUploads {
+		return "", errors.New("Too many uploads in progress.")
+	}
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(c.Context())
+	upload := &blobUpload{writer: writer, cancel: cancel, done: make(chan blobResult, 1)}
+	info := &BlobInfo{Key: req.Key, ContentType: req.ContentType, Hash: req.Hash, Owner: owner}
+	go func() {
+		stored, err := a.Blobs.Put(ctx, info, reader)
+		if err != nil {
+			reader.CloseWithError(err)
+		}
+		upload.done <- blobResult{info: stored, err: err}
+	}()
+	if c.uploads == nil {
+		c.uploads = make(map[string]*blobUpload)
+	}
+	id := uuid.NewV4().String()
+	c.uploads[id] = upload
+	return id, nil
+}
+
+// HandleBlob runs the socket upload protocol.  blobstart opens an upload and
+// answers with its id, each blobchunk carries the next part of the content
+// as its payload with the id as its destination, and blobend answers with the
+// stored blob once it is complete.  blobabort drops an upload, as does
+// closing the connection.
+func (c *Conn) HandleBlob(msg *Message) error {
+	req := &BlobRequest{}
+	res := &BlobResponse{Status: "ok"}
+	var err error
+	if msg.Event == "blobchunk" {
+		req.Id = msg.Dst
+	} else {
+		err = json.Unmarshal(msg.Payload, req)
+	}
+	if err == nil {
+		switch msg.Event {
+		case "blobstart":
+			if res.Id, err = c.startBlob(req); err == nil {
+				res.Key = req.Key
+				res.ChunkSize = c.Application.blobChunk
+			}
+		case "blobchunk":
+			res.Id = req.Id
+			upload, ok := c.uploads[req.Id]
+			if !ok {
+				err = ErrNotFound
+			} else if _, err = upload.writer.Write(msg.Payload); err != nil {
+				delete(c.uploads, req.Id)
+				upload.abort()
+			} else {
+				// Chunks are only answered when they fail.
+				return nil
+			}
+		case "blobend":
+			res.Id = req.Id
+			upload, ok := c.uploads[req.Id]
+			if !ok {
+				err = ErrNotFound
+				break
+			}
+			delete(c.uploads, req.Id)
+			upload.writer.Close()
+			result := <-upload.done
+			upload.cancel()
+			res.Blob, err = result.info, result.err
+		case "blobabort":
+			res.Id = req.Id
+			if upload, ok := c.uploads[req.Id]; ok {
+				delete(c.uploads, req.Id)
+				upload.abort()
+			}
+		}
+	}
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	response := &Message{
+		RoomLength:    len("root"),
+		Room:          "root",
+		EventLength:   len("blob"),
+		Event:         "blob",
+		DstLength:     len(c.Id),
+		Dst:           c.Id,
+		SrcLength:     len(c.Id),
+		Src:           c.Id,
+		PayloadLength: len(payload),
+		Payload:       payload,
+	}
+	c.deliver(MessageToBytes(response))
+	return nil
+}
+
+// abortBlobs drops the uploads a closing connection left open.
+func (c *Conn) abortBlobs() {
+	for id, upload := range c.uploads {
+		delete(c.uploads, id)
+		upload.abort()
+	}
+}
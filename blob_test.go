@@ -0,0 +1,230 @@
+//    Title: blob_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blobApp opens a memory database and a database blob store of 4 byte chunks
+// and blobs of at most 16 bytes.
+func blobApp(t *testing.T) (*App, *DBBlobStore) {
+	t.Helper()
+	a := NewApp()
+	db, err := a.NewDatabase("memory", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DB = db
+	store, err := a.NewBlobStore(map[string]string{"store": "database", "chunk_size": "4", "max_size": "16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, store.(*DBBlobStore)
+}
+
+func readBlob(t *testing.T, store BlobStore, key string) string {
+	t.Helper()
+	content, _, err := store.Get(context.Background(), key)
+	mustStore(t, err)
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	mustStore(t, err)
+	return string(data)
+}
+
+// TestBlobChunksHaveTheirOwnTable checks that the blob table only holds the
+// blobs' info, so object reads of it never see chunks.
+func TestBlobChunksHaveTheirOwnTable(t *testing.T) {
+	a, store := blobApp(t)
+	ctx := context.Background()
+	for _, content := range []string{"hello world", "replaced"} {
+		_, err := store.Put(ctx, &BlobInfo{Key: "notes/a.txt"}, strings.NewReader(content))
+		mustStore(t, err)
+		if got := readBlob(t, store, "notes/a.txt"); got != content {
+			t.Fatalf("read %q, want %q", got, content)
+		}
+	}
+	tests := []struct {
+		table string
+		want  int
+	}{
+		{"blobs", 1},
+		{"blobs_chunks", 2},
+	}
+	for _, test := range tests {
+		records, err := a.DB.Store.All(ctx, test.table)
+		mustStore(t, err)
+		if len(records) != test.want {
+			t.Errorf("%s holds %d records, want %d", test.table, len(records), test.want)
+		}
+	}
+	mustStore(t, store.Delete(ctx, "notes/a.txt"))
+	for _, table := range []string{"blobs", "blobs_chunks"} {
+		records, err := a.DB.Store.All(ctx, table)
+		mustStore(t, err)
+		if len(records) != 0 {
+			t.Errorf("%s holds %d records after the delete", table, len(records))
+		}
+	}
+}
+
+// TestBlobReadsChunksOfOldBlobs checks that blobs written while chunks shared
+// the blob table can still be read and deleted.
+func TestBlobReadsChunksOfOldBlobs(t *testing.T) {
+	a, store := blobApp(t)
+	ctx := context.Background()
+	meta := &dbBlob{BlobInfo: BlobInfo{Key: "old", Size: 6}, Upload: "u", Chunks: 2}
+	mustStore(t, a.DB.InsertObj(ctx, "blobs", "old", meta))
+	mustStore(t, store.putChunk(ctx, "blobs", chunkKey("old", "u", 0), []byte("abcd")))
+	mustStore(t, store.putChunk(ctx, "blobs", chunkKey("old", "u", 1), []byte("ef")))
+	if got := readBlob(t, store, "old"); got != "abcdef" {
+		t.Fatalf("read %q, want abcdef", got)
+	}
+	mustStore(t, store.Delete(ctx, "old"))
+	records, err := a.DB.Store.All(ctx, "blobs")
+	mustStore(t, err)
+	if len(records) != 0 {
+		t.Fatalf("blobs holds %d records after the delete", len(records))
+	}
+}
+
+func TestBlobTablesRefusePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		table  string
+		policy *TablePolicy
+		err    error
+	}{
+		{"ttl", "blobs", &TablePolicy{TTL: time.Hour}, ErrBlobPolicy},
+		{"soft delete", "blobs", &TablePolicy{SoftDelete: true}, ErrBlobPolicy},
+		{"chunks", "blobs_chunks", &TablePolicy{SoftDelete: true}, ErrBlobPolicy},
+		{"none", "blobs", nil, nil},
+		{"other table", "notes", &TablePolicy{SoftDelete: true}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, _ := blobApp(t)
+			if err := a.DB.SetTablePolicy(test.table, test.policy); err != test.err {
+				t.Fatalf("after the blob store: got %v, want %v", err, test.err)
+			}
+			a = NewApp()
+			db, err := a.NewDatabase("memory", map[string]string{})
+			mustStore(t, err)
+			a.DB = db
+			mustStore(t, db.SetTablePolicy(test.table, test.policy))
+			if _, err := a.NewBlobStore(map[string]string{"store": "database"}); err != test.err {
+				t.Fatalf("before the blob store: got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// socketUpload uploads content to key over the socket as username, declaring
+// size in blobstart, and returns the reply that ended the upload.
+func socketUpload(t *testing.T, a *App, username string, scope *Scope, key string, size int64, content string) *BlobResponse {
+	t.Helper()
+	c := &Conn{Application: a, Id: "uploader", Username: username, Privilege: "user", Scope: scope, Send: make(chan []byte, 16)}
+	if username == "root" {
+		c.Privilege = "admin"
+	}
+	send := func(event string, dst string, payload []byte) *BlobResponse {
+		msg := &Message{RoomLength: 4, Room: "root", EventLength: len(event), Event: event, DstLength: len(dst), Dst: dst, PayloadLength: len(payload), Payload: payload}
+		mustStore(t, c.HandleData(MessageToBytes(msg), msg))
+		select {
+		case data := <-c.Send:
+			res := &BlobResponse{}
+			mustStore(t, json.Unmarshal(BytesToMessage(data).Payload, res))
+			return res
+		default:
+			return nil
+		}
+	}
+	start, _ := json.Marshal(&BlobRequest{Key: key, Size: size})
+	res := send("blobstart", "", start)
+	if res.Status != "ok" {
+		return res
+	}
+	id := res.Id
+	for i := 0; i < len(content); i += 4 {
+		end := i + 4
+		if end > len(content) {
+			end = len(content)
+		}
+		if res := send("blobchunk", id, []byte(content[i:end])); res != nil {
+			return res
+		}
+	}
+	finish, _ := json.Marshal(&BlobRequest{Id: id})
+	return send("blobend", "", finish)
+}
+
+// TestSocketBlobUploads runs uploads in order against one store, so later
+// ones meet the blobs stored by earlier ones.
+func TestSocketBlobUploads(t *testing.T) {
+	a, store := blobApp(t)
+	a.Access = map[string]map[string]string{"blobs": {"read": "all", "write": "user", "admin": "admin"}}
+	putOnly := &Scope{Events: []string{"putblob"}}
+	socketOnly := &Scope{Events: []string{"blobstart", "blobchunk", "blobend"}}
+	tests := []struct {
+		name     string
+		username string
+		scope    *Scope
+		key      string
+		size     int64
+		content  string
+		err      error
+		owner    string
+	}{
+		{"owner stores", "jon", nil, "a", 0, "hello", nil, "jon"},
+		{"owner replaces", "jon", nil, "a", 0, "hello again", nil, "jon"},
+		{"other user", "ann", nil, "a", 0, "mine now", ErrForbidden, ""},
+		{"admin keeps the owner", "root", nil, "a", 0, "admin", nil, "jon"},
+		{"guest", "guest", nil, "b", 0, "hello", ErrForbidden, ""},
+		{"declared too large", "ann", nil, "b", 17, "hello", ErrBlobTooLarge, ""},
+		{"too large", "ann", nil, "b", 0, strings.Repeat("x", 20), ErrBlobTooLarge, ""},
+		{"invalid key", "ann", nil, "../b", 0, "hello", ErrBlobKey, ""},
+		{"putblob scope", "ann", putOnly, "b", 0, "hello", nil, "ann"},
+		{"socket events scope", "ann", socketOnly, "c", 0, "hello", ErrForbidden, ""},
+	}
+	for _, test := range tests {
+		res := socketUpload(t, a, test.username, test.scope, test.key, test.size, test.content)
+		if test.err != nil {
+			if res.Status != "error" || res.Error != test.err.Error() {
+				t.Errorf("%s: got %s %q, want %q", test.name, res.Status, res.Error, test.err)
+			}
+			continue
+		}
+		if res.Status != "ok" || res.Blob == nil {
+			t.Errorf("%s: got %s %q", test.name, res.Status, res.Error)
+			continue
+		}
+		info, err := store.Stat(context.Background(), test.key)
+		mustStore(t, err)
+		if info.Owner != test.owner || readBlob(t, store, test.key) != test.content {
+			t.Errorf("%s: stored %q owned by %q, want %q owned by %q", test.name, readBlob(t, store, test.key), info.Owner, test.content, test.owner)
+		}
+	}
+	if _, err := store.Stat(context.Background(), "c"); err != ErrNotFound {
+		t.Fatalf("a forbidden upload was stored: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+//    Title: cache.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CachePolicy sets how a table is cached: objects are kept for TTL after
+// they are read, and at most Size of them are kept, the least recently used
+// going first.
+type CachePolicy struct {
+	TTL  time.Duration
+	Size int
+}
+
+// CacheStats counts the reads of a cached table.  Listing the whole table
+// counts as one read.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+// Cache keeps recently read records of the tables it has a policy for in
+// memory.  Writes made through the Database invalidate the objects they touch
+// and the cached listing of the table; writes made by other processes are
+// only seen once the cached copy expires.
+type Cache struct {
+	mu     sync.Mutex
+	tables map[string]*tableCache
+}
+
+type tableCache struct {
+	policy  *CachePolicy
+	order   *list.List
+	entries map[string]*list.Element
+	all     []Record
+	expires time.Time
+	stats   CacheStats
+	// generation grows with each invalidation, so that a read which raced
+	// with a write does not cache what it read.
+	generation uint64
+}
+
+type cacheEntry struct {
+	record  Record
+	expires time.Time
+}
+
+func NewCache() *Cache {
+	return &Cache{tables: make(map[string]*tableCache)}
+}
+
+// ParseCachePolicy reads a policy from config.json: ttl, e.g. 30s (default is
+// 1m), and size (default is 1000).
+func ParseCachePolicy(params map[string]string) (*CachePolicy, error) {
+	policy := &CachePolicy{TTL: time.Minute, Size: 1000}
+	if val, ok := params["ttl"]; ok {
+		ttl, err := time.ParseDuration(val)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid cache value for ttl: %s", val)
+		}
+		policy.TTL = ttl
+	}
+	if val, ok := params["size"]; ok {
+		size, err := strconv.Atoi(val)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("Invalid cache value for size: %s", val)
+		}
+		policy.Size = size
+	}
+	return policy, nil
+}
+
+// SetPolicy caches table according to policy, or stops caching it if policy
+// is nil.  Records cached under an earlier policy are dropped.
+func (c *Cache) SetPolicy(table string, policy *CachePolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if policy == nil {
+		delete(c.tables, table)
+		return
+	}
+	c.tables[table] = &tableCache{
+		policy:  policy,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Stats returns the counters of every cached table.
+func (c *Cache) Stats() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	if c == nil {
+		return stats
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for table, cached := range c.tables {
+		cached.stats.Entries = cached.order.Len()
+		stats[table] = cached.stats
+	}
+	return stats
+}
+
+// get returns the cached record of key, and whether table is cached at all
+// along with its generation.
+func (c *Cache) get(table string, key string) (*Record, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tables[table]
+	if !ok {
+		return nil, 0, false
+	}
+	if element, ok := cached.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if now := time.Now(); now.Before(entry.expires) && entry.record.alive(unixMillis(now)) {
+			cached.order.MoveToFront(element)
+			cached.stats.Hits++
+			record := entry.record
+			return &record, cached.generation, true
+		}
+		cached.order.Remove(element)
+		delete(cached.entries, key)
+	}
+	cached.stats.Misses++
+	return nil, cached.generation, true
+}
+
+func (c *Cache) put(table string, record *Record, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tables[table]
+	if !ok || cached.generation != generation {
+		return
+	}
+	entry := &cacheEntry{record: *record, expires: time.Now().Add(cached.policy.TTL)}
+	if element, ok := cached.entries[record.Key]; ok {
+		element.Value = entry
+		cached.order.MoveToFront(element)
+		return
+	}
+	cached.entries[record.Key] = cached.order.PushFront(entry)
+	for cached.order.Len() > cached.policy.Size {
+		oldest := cached.order.Back()
+		cached.order.Remove(oldest)
+		delete(cached.entries, oldest.Value.(*cacheEntry).record.Key)
+		cached.stats.Evictions++
+	}
+}
+
+// getAll returns a copy of the cached listing of table, and whether table is
+// cached at all along with its generation.
+func (c *Cache) getAll(table string) ([]Record, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tables[table]
+	if !ok {
+		return nil, 0, false
+	}
+	if now := time.Now(); cached.all != nil && now.Before(cached.expires) {
+		cached.stats.Hits++
+		records := make([]Record, 0, len(cached.all))
+		for _, record := range cached.all {
+			if record.alive(unixMillis(now)) {
+				records = append(records, record)
+			}
+		}
+		return records, cached.generation, true
+	}
+	cached.all = nil
+	cached.stats.Misses++
+	return nil, cached.generation, true
+}
+
+func (c *Cache) putAll(table string, records []Record, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.tables[table]; ok && cached.generation == generation {
+		cached.all = append([]Record(nil), records...)
+		cached.expires = time.Now().Add(cached.policy.TTL)
+	}
+}
+
+// Invalidate drops the cached record of key and the cached listing of table.
+func (c *Cache) Invalidate(table string, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tables[table]
+	if !ok {
+		return
+	}
+	if element, ok := cached.entries[key]; ok {
+		cached.order.Remove(element)
+		delete(cached.entries, key)
+	}
+	cached.all = nil
+	cached.generation++
+}
+
+// cached reports whether reads of db may use its cache.  Reads inside a
+// transaction go to the store, which sees the transaction's own writes.
+func (db *Database) cached() *Cache {
+	if _, ok := db.Store.(TxStore); ok {
+		return nil
+	}
+	return db.Cache
+}
+
+// get reads the record of key through the cache.
+func (db *Database) get(ctx context.Context, table string, key string) (*Record, error) {
+	cache := db.cached()
+	record, generation, ok := cache.get(table, key)
+	if record != nil {
+		return record, nil
+	} else if !ok {
+		return db.Store.Get(ctx, table, key)
+	}
+	record, err := db.Store.Get(ctx, table, key)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(table, record, generation)
+	return record, nil
+}
+
+// all reads every record of table through the cache.
+func (db *Database) all(ctx context.Context, table string) ([]Record, error) {
+	cache := db.cached()
+	records, generation, ok := cache.getAll(table)
+	if records != nil {
+		return records, nil
+	} else if !ok {
+		return db.Store.All(ctx, table)
+	}
+	records, err := db.Store.All(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	cache.putAll(table, records, generation)
+	return records, nil
+}
+
+// configureCaches applies the cache section of config.json.
+func (a *App) configureCaches() error {
+	for name, params := range a.Cache {
+		db, table, err := a.TableNamed(name)
+		if err != nil {
+			return err
+		}
+		if !ValidTable(table) {
+			return &TableError{Table: table, Invalid: true}
+		}
+		policy, err := ParseCachePolicy(params)
+		if err != nil {
+			return err
+		}
+		if db.Cache == nil {
+			db.Cache = NewCache()
+		}
+		db.Cache.SetPolicy(table, policy)
+	}
+	return nil
+}
+
+// CacheStats returns the cache counters of every database, named by table or
+// database.table like the cache section of config.json.
+func (a *App) CacheStats() map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	for _, db := range a.DBs {
+		for table, tableStats := range db.Cache.Stats() {
+			stats[db.feed(table)] = tableStats
+		}
+	}
+	return stats
+}
+
+// CacheHandler serves the cache counters to users the access rules allow to
+// read "cache".
+func (a *App) CacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	user, _, err := a.RequestUser(w, r)
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	if !a.CanAccess("cache", "read", user) {
+		WriteError(w, 403, ErrForbidden.Error(), nil)
+		return
+	}
+	writeJSON(w, a.CacheStats())
+}
@@ -0,0 +1,128 @@
+//    Title: cache_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// cachedDatabase opens a memory database caching table posts, which holds
+// a = {"n": 1}.
+func cachedDatabase(t *testing.T, policy *CachePolicy) *Database {
+	t.Helper()
+	ctx := context.Background()
+	db, err := NewApp().NewDatabase("memory", map[string]string{})
+	mustStore(t, err)
+	t.Cleanup(func() { db.Close() })
+	mustStore(t, db.CreateTable(ctx, "posts"))
+	db.Cache = NewCache()
+	db.Cache.SetPolicy("posts", policy)
+	mustStore(t, db.InsertObj(ctx, "posts", "a", map[string]interface{}{"n": 1}))
+	return db
+}
+
+// TestCacheInvalidation checks which writes a cached read sees.  Writes to
+// the store stand in for another process and are only seen once the cache
+// is invalidated.
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	db := cachedDatabase(t, &CachePolicy{TTL: time.Hour, Size: 10})
+	steps := []struct {
+		name  string
+		write func() error
+		n     interface{}
+		count int
+	}{
+		{"first read", func() error { return nil }, 1.0, 1},
+		{"store write", func() error {
+			_, err := db.Store.Update(ctx, "posts", "a", []byte(`{"n":2}`), 0)
+			return err
+		}, 1.0, 1},
+		{"store insert", func() error { return db.Store.Insert(ctx, "posts", "b", []byte(`{"n":1}`)) }, 1.0, 1},
+		{"update", func() error { return db.UpdateObj(ctx, "posts", "a", map[string]interface{}{"n": 3}) }, 3.0, 2},
+		{"patch", func() error {
+			_, err := db.PatchObj(ctx, "posts", "a", map[string]interface{}{"n": 4})
+			return err
+		}, 4.0, 2},
+		{"upsert", func() error { return db.UpsertObj(ctx, "posts", "a", map[string]interface{}{"n": 5}) }, 5.0, 2},
+		{"insert", func() error { return db.InsertObj(ctx, "posts", "c", map[string]interface{}{"n": 1}) }, 5.0, 3},
+		{"delete", func() error { return db.DeleteObj(ctx, "posts", "a") }, nil, 2},
+	}
+	for _, step := range steps {
+		mustStore(t, step.write())
+		obj, err := db.GetObj(ctx, "posts", "a")
+		if step.n == nil {
+			expectErr(t, err, ErrNotFound)
+		} else {
+			mustStore(t, err)
+			if obj.(map[string]interface{})["n"] != step.n {
+				t.Fatalf("%s: read %v, want n %v", step.name, obj, step.n)
+			}
+		}
+		objs, err := db.GetAllObjs(ctx, "posts")
+		mustStore(t, err)
+		if len(objs) != step.count {
+			t.Fatalf("%s: listed %d objects, want %d", step.name, len(objs), step.count)
+		}
+	}
+}
+
+func TestCacheEvictsAndExpires(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		policy *CachePolicy
+		wait   time.Duration
+		stats  CacheStats
+	}{
+		{"hit", &CachePolicy{TTL: time.Hour, Size: 10}, 0, CacheStats{Hits: 3, Misses: 3, Entries: 3}},
+		{"evicted", &CachePolicy{TTL: time.Hour, Size: 2}, 0, CacheStats{Hits: 2, Misses: 4, Evictions: 2, Entries: 2}},
+		{"expired", &CachePolicy{TTL: time.Millisecond, Size: 10}, 5 * time.Millisecond, CacheStats{Misses: 6, Entries: 3}},
+	}
+	for _, test := range tests {
+		db := cachedDatabase(t, test.policy)
+		mustStore(t, db.InsertObj(ctx, "posts", "b", map[string]interface{}{"n": 1}))
+		mustStore(t, db.InsertObj(ctx, "posts", "c", map[string]interface{}{"n": 1}))
+		for _, key := range []string{"a", "b", "c", "c", "b", "a"} {
+			_, err := db.GetObj(ctx, "posts", key)
+			mustStore(t, err)
+			time.Sleep(test.wait)
+		}
+		if stats := db.Cache.Stats()["posts"]; stats != test.stats {
+			t.Errorf("%s: got %+v, want %+v", test.name, stats, test.stats)
+		}
+	}
+}
+
+// TestCacheSkipsRacedReads checks that a record read before a write is not
+// cached after it.
+func TestCacheSkipsRacedReads(t *testing.T) {
+	cache := NewCache()
+	cache.SetPolicy("posts", &CachePolicy{TTL: time.Hour, Size: 10})
+	_, generation, _ := cache.get("posts", "a")
+	cache.Invalidate("posts", "a")
+	cache.put("posts", &Record{Key: "a", Data: []byte(`{"n":1}`), Version: 1}, generation)
+	cache.putAll("posts", []Record{{Key: "a", Data: []byte(`{"n":1}`), Version: 1}}, generation)
+	if record, _, _ := cache.get("posts", "a"); record != nil {
+		t.Fatalf("cached %s read before the write", record.Data)
+	}
+	if records, _, _ := cache.getAll("posts"); records != nil {
+		t.Fatalf("cached a listing read before the write")
+	}
+}
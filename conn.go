@@ -18,12 +18,17 @@ package rtgo
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"html"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -47,26 +52,106 @@ type Conn struct {
 	Send        chan []byte
 	Rooms       map[string]*Room
 	Privilege   string
+	Username    string
+	Session     string
+	Scope       *Scope
+	Addr        string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	uploads     map[string]*blobUpload
+	closing     chan struct{}
+	closeOnce   sync.Once
+}
+
+// Close asks the connection to close itself: its WritePump sends a close
+// message and closes the socket, which ends its ReadPump.  It is safe to call
+// from any goroutine, any number of times.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		if c.closing != nil {
+			close(c.closing)
+		}
+	})
+}
+
+// deliver queues msg for the WritePump.  It gives up once the connection is
+// closing or its ReadPump has exited, so it never blocks on a connection that
+// is gone, and reports whether msg was queued.
+func (c *Conn) deliver(msg []byte) bool {
+	select {
+	case c.Send <- msg:
+		return true
+	case <-c.closing:
+		return false
+	case <-c.Context().Done():
+		return false
+	}
+}
+
+// offer queues msg only if the connection has room for it, for senders such
+// as rooms that must not be held up by one slow member.
+func (c *Conn) offer(msg []byte) bool {
+	select {
+	case c.Send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Context is cancelled once the connection's ReadPump exits, abandoning any
+// database calls still running on its behalf.
+func (c *Conn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 func (c *Conn) SendView(path string) {
+	data, view := c.renderView(path)
+	if data == nil {
+		return
+	}
+	c.Application.watchView(c, view)
+	c.sendResponse(data)
+}
+
+// renderView renders the template of the route matching path.  For live
+// routes it also returns the view to watch for changes.
+func (c *Conn) renderView(path string) (map[string]string, *liveView) {
 	var (
-		doc bytes.Buffer
-		err error
+		doc  bytes.Buffer
+		view *liveView
 	)
+	full := path
+	next := ""
+	params := url.Values{}
+	if parts := strings.SplitN(path, "?", 2); len(parts) == 2 {
+		path = parts[0]
+		params, _ = url.ParseQuery(parts[1])
+	}
 	route := c.Application.FindRoute(path)
 	if _, ok := route["template"]; !ok {
 		log.Println("No template for the specified path: ", path)
-		return
+		return nil, nil
 	}
 	collection := make([]interface{}, 0)
 	if _, ok := route["table"]; ok {
-		if _, ok := route["key"]; ok {
-			if obj, err := c.Application.DB.GetObj(route["table"], route["key"]); err == nil {
+		db, err := c.Application.DBNamed(route["database"])
+		if err != nil {
+			log.Println("no database for ", path, ": ", err)
+		} else if _, ok := route["key"]; ok {
+			if obj, err := db.GetObj(c.Context(), route["table"], route["key"]); err == nil {
 				collection = append(collection, obj)
 			}
-		} else {
-			collection, _ = c.Application.DB.GetAllObjs(route["table"])
+		} else if query, err := c.Application.RouteQuery(route, params); err != nil {
+			log.Println("invalid query for ", path, ": ", err)
+		} else if collection, next, err = db.Query(c.Context(), route["table"], query); err != nil {
+			log.Println("error querying ", route["table"], ": ", err)
+		}
+		if db != nil && route["live"] == "true" {
+			view = &liveView{conn: c, path: full, feed: db.feed(route["table"]), key: route["key"]}
 		}
 	}
 	c.Application.Templates.ExecuteTemplate(&doc, route["template"], collection)
@@ -74,7 +159,15 @@ func (c *Conn) SendView(path string) {
 		"view":        route["template"],
 		"template":    html.UnescapeString(doc.String()),
 		"controllers": route["controllers"],
+		"next":        next,
+	}
+	if view != nil {
+		data["live"] = "true"
 	}
+	return data, view
+}
+
+func (c *Conn) sendResponse(data map[string]string) {
 	payload, err := json.Marshal(&data)
 	if err != nil {
 		log.Println("error encoding json: ", err)
@@ -92,21 +185,39 @@ func (c *Conn) SendView(path string) {
 		PayloadLength: len(payload),
 		Payload:       payload,
 	}
-	c.Send <- MessageToBytes(response)
+	c.deliver(MessageToBytes(response))
 }
 
 func (c *Conn) HandleData(data []byte, msg *Message) error {
+	switch msg.Event {
+	case "blobstart", "blobchunk", "blobend", "blobabort":
+		// Uploads need putblob in the root room, as over HTTP, which
+		// HandleBlob checks itself.
+		return c.HandleBlob(msg)
+	}
+	if !c.Scope.Allows(msg.Room, msg.Event) {
+		return fmt.Errorf("Event %s in room %s is not permitted for %s.", msg.Event, msg.Room, c.Id)
+	}
 	switch msg.Event {
 	case "join":
+		if !c.Application.canFollow(msg.Room, &User{Username: c.Username, Privilege: c.Privilege}) {
+			return fmt.Errorf("Room %s is not permitted for %s.", msg.Room, c.Id)
+		}
 		c.Join(msg.Room)
 	case "leave":
 		c.Leave(msg.Room)
 	case "request":
 		c.SendView(string(msg.Payload))
+	case "changepassword", "changeemail", "deleteaccount":
+		return c.HandleAccount(msg)
+	case "getobj", "putobj", "patchobj", "deleteobj":
+		return c.HandleObject(msg)
+	case "history":
+		return c.HandleHistory(msg)
 	default:
 		if msg.Dst != "" {
 			if dst, ok := c.Rooms[msg.Room].Members[msg.Dst]; ok {
-				dst.Send <- data
+				dst.deliver(data)
 			}
 		} else {
 			c.Emit(data, msg)
@@ -118,6 +229,12 @@ func (c *Conn) HandleData(data []byte, msg *Message) error {
 
 func (c *Conn) ReadPump() {
 	defer func() {
+		if c.cancel != nil {
+			c.cancel()
+		}
+		c.abortBlobs()
+		c.Application.removeConnection(c)
+		c.Application.watchView(c, nil)
 		for _, room := range c.Rooms {
 			room.Leavechan <- c
 		}
@@ -169,6 +286,7 @@ func (c *Conn) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.Socket.Close()
+		c.Close()
 	}()
 	for {
 		select {
@@ -180,6 +298,9 @@ func (c *Conn) WritePump() {
 			if err := c.Write(websocket.BinaryMessage, msg); err != nil {
 				return
 			}
+		case <-c.closing:
+			c.Write(websocket.CloseMessage, []byte{})
+			return
 		case <-ticker.C:
 			if err := c.Write(websocket.PingMessage, []byte{}); err != nil {
 				return
@@ -189,25 +310,20 @@ func (c *Conn) WritePump() {
 }
 
 func (c *Conn) Join(name string) {
-	var room *Room
-	if _, ok := c.Application.RoomManager[name]; ok {
-		room = c.Application.RoomManager[name]
-	} else {
-		room = c.Application.NewRoom(name)
-	}
+	room := c.Application.openRoom(name)
 	c.Rooms[name] = room
 	room.Join(c)
 }
 
 func (c *Conn) Leave(name string) {
-	if room, ok := c.Application.RoomManager[name]; ok {
+	if room := c.Application.room(name); room != nil {
 		delete(c.Rooms, room.Name)
 		room.Leave(c)
 	}
 }
 
 func (c *Conn) Emit(data []byte, msg *Message) {
-	if room, ok := c.Application.RoomManager[msg.Room]; ok {
+	if room := c.Application.room(msg.Room); room != nil {
 		room.Emit(c, data)
 	}
 }
@@ -17,206 +17,680 @@
 package rtgo
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/tpjg/goriakpbc"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+const defaultTimeout = 10 * time.Second
+
+var (
+	ErrNotFound      = errors.New("Object does not exist.")
+	ErrExists        = errors.New("Object already exists.")
+	ErrConflict      = errors.New("Object version conflict.")
+	ErrNoTable       = errors.New("Table does not exist.")
+	ErrUnknownDriver = errors.New("Unknown database driver.")
+	ErrNoTx          = errors.New("Database driver does not support transactions.")
+	ErrNoExpiry      = errors.New("Database driver does not support expiry or soft deletes.")
+	ErrNoUnique      = errors.New("Database driver does not support unique indexes.")
+	tablePattern     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+)
+
+// TableError reports a table name that is not a plain identifier, or a table
+// the database was never asked to create.  Table names can reach the
+// database from route captures and request paths, so they are checked before
+// any query is built.
+type TableError struct {
+	Table   string
+	Invalid bool
+}
+
+func (e *TableError) Error() string {
+	if e.Invalid {
+		return fmt.Sprintf("Invalid table name: %q", e.Table)
+	}
+	return fmt.Sprintf("Unknown table: %q", e.Table)
+}
+
+func (e *TableError) Unwrap() error {
+	return ErrNoTable
+}
+
+// ValidTable reports whether name can be used as a table name: a letter or
+// underscore followed by at most 62 letters, digits or underscores.
+func ValidTable(name string) bool {
+	return tablePattern.MatchString(name)
+}
+
+// Record is an object as stored.  Expires and Deleted are times in
+// milliseconds since the epoch, 0 if the record never expires or has not been
+// soft deleted; drivers that do not implement Expirer leave them at 0.
+type Record struct {
+	Key     string
+	Data    []byte
+	Version int64
+	Expires int64
+	Deleted int64
+}
+
+// alive reports whether record exists and has neither expired by now nor been
+// soft deleted.
+func (record *Record) alive(now int64) bool {
+	return record != nil && record.Deleted == 0 && (record.Expires == 0 || record.Expires > now)
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Store is implemented by every storage driver.  Drivers deal in raw JSON
+// blobs; encoding and decoding is left to Database.
+//
+// Every record carries a version that starts at 1 and grows by one with each
+// write.  Update and Delete take the version the caller expects the record to
+// have and fail with ErrConflict if it differs; a version of 0 skips the
+// check, and a Delete without one succeeds for a missing key.  store_test.go
+// holds the suite every driver must pass.
+type Store interface {
+	Open(ctx context.Context, params map[string]string) error
+	CreateTable(ctx context.Context, table string) error
+	Get(ctx context.Context, table string, key string) (*Record, error)
+	All(ctx context.Context, table string) ([]Record, error)
+	Insert(ctx context.Context, table string, key string, data []byte) error
+	Update(ctx context.Context, table string, key string, data []byte, version int64) (int64, error)
+	Upsert(ctx context.Context, table string, key string, data []byte) (int64, error)
+	Delete(ctx context.Context, table string, key string, version int64) error
+	Close() error
+}
+
+// TxStore is a Store whose operations belong to one transaction.
+type TxStore interface {
+	Store
+	Commit() error
+	Rollback() error
+}
+
+// Transactor is implemented by drivers that can group several operations
+// into one atomic transaction.  The SQL drivers do; riak, memory and file do
+// not, and Database.Tx fails with ErrNoTx for them.
+type Transactor interface {
+	Begin(ctx context.Context) (TxStore, error)
+}
+
+// Pinger is implemented by drivers that can check their connection is alive.
+// Drivers that do not implement it are always considered healthy.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Expirer is implemented by drivers that keep an expiry time and a soft
+// delete mark with each record.  Records that have expired or were soft
+// deleted are left out of Get, All, Query and Find and are treated as missing
+// by writes, until Reap removes them for good.  Times are in milliseconds
+// since the epoch.
+//
+// WriteExpiring runs the Insert, Update or Upsert named by op and sets when
+// the record expires in the same write, or keeps its expiry for 0.  Expire
+// sets when a live record expires, or clears it for 0.  SoftDelete
+// marks a live record deleted, checking the version like Delete, and Restore
+// unmarks it.  FindTombstones returns the soft deleted records whose indexed
+// field equals value.  Reap removes the records that have expired and the
+// ones soft deleted before the given time, keeping every soft deleted one
+// for 0.
+type Expirer interface {
+	WriteExpiring(ctx context.Context, op string, table string, key string, data []byte, version int64, expires int64) (int64, error)
+	Expire(ctx context.Context, table string, key string, expires int64) error
+	SoftDelete(ctx context.Context, table string, key string, version int64) error
+	Restore(ctx context.Context, table string, key string) (int64, error)
+	Tombstones(ctx context.Context, table string) ([]Record, error)
+	FindTombstones(ctx context.Context, index *Index, value interface{}) ([]Record, error)
+	Reap(ctx context.Context, table string, before int64) (int, error)
+}
+
+// Scanner is implemented by drivers that can hand out the records of a table
+// one at a time instead of reading them all into memory first.  Scan stops at
+// the first error returned by fn.
+type Scanner interface {
+	Scan(ctx context.Context, table string, fn func(record *Record) error) error
+}
+
 type Database struct {
 	Application *App
 	Name        string
+	Driver      string
 	Params      map[string]string
-	Buckets     map[string]*riak.Bucket
-	Dsn         string
-	Create      string
-	Connection  *sql.DB
+	Store       Store
+	Indexes     []*Index
+	Timeout     time.Duration
+	Cache       *Cache
+	tables      *tableSet
+	stopReaper  context.CancelFunc
 }
 
-func (db *Database) GetAllObjs(table string) ([]interface{}, error) {
-	data := make([]interface{}, 0)
-	if db.Name == "riak" {
-		if _, exists := db.Buckets[table]; !exists {
-			return nil, errors.New("Bucket does not exist.")
-		}
-		keys, err := db.Buckets[table].ListKeys()
-		if err != nil {
-			return nil, err
-		}
-		for _, key := range keys {
-			obj, err := db.GetObj(table, string(key))
-			if err != nil {
-				return nil, err
-			}
-			data = append(data, obj)
-		}
-	} else {
-		query := fmt.Sprintf("SELECT * FROM %s", table)
-		rows, err := db.Connection.Query(query)
-		if err != nil {
-			return nil, err
-		}
-		cols, err := rows.Columns()
-		if err != nil {
-			return nil, err
-		}
-		blobs := make([][]byte, len(cols))
-		dest := make([]interface{}, len(cols))
-		for i := range cols {
-			dest[i] = &blobs[i]
-		}
-		for rows.Next() {
-			if err := rows.Scan(dest...); err != nil {
-				return nil, err
-			}
-			for i, blob := range blobs {
-				var value interface{}
-				col := cols[i]
-				if col == "hash" {
-					continue
-				} else if err := json.Unmarshal(blob, &value); err != nil {
-					return nil, err
-				}
-				data = append(data, value)
-			}
-		}
+// tableSet holds the tables created through a Database.  It is shared with
+// the copies made by In.
+type tableSet struct {
+	mu       sync.RWMutex
+	names    map[string]bool
+	policies map[string]*TablePolicy
+	blobs    map[string]bool
+}
+
+func newTableSet() *tableSet {
+	return &tableSet{names: make(map[string]bool), policies: make(map[string]*TablePolicy), blobs: make(map[string]bool)}
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]func() Store)
+)
+
+func RegisterDriver(name string, driver func() Store) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("rtgo: RegisterDriver driver is nil")
 	}
-	return data, nil
+	if _, dup := drivers[name]; dup {
+		panic("rtgo: RegisterDriver called twice for driver " + name)
+	}
+	drivers[name] = driver
 }
 
-func (db *Database) GetObj(table string, key string) (interface{}, error) {
-	var data interface{}
-	if db.Name == "riak" {
-		if _, exists := db.Buckets[table]; !exists {
-			return nil, errors.New("Bucket does not exist.")
-		}
-		if exists, _ := db.Buckets[table].Exists(key); !exists {
-			return nil, errors.New("Object does not exist.")
-		}
-		obj, err := db.Buckets[table].Get(key)
-		if err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal(obj.Data, &data); err != nil {
-			return nil, err
-		}
-	} else {
-		query := ""
-		blob := make([]byte, 0)
-		if db.Name == "postgres" {
-			query = fmt.Sprintf("SELECT data FROM %s WHERE hash = $1", table)
-		} else {
-			query = fmt.Sprintf("SELECT data FROM %s WHERE hash = ?", table)
-		}
-		if err := db.Connection.QueryRow(query, key).Scan(&blob); err != nil {
-			return nil, err
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewStore(name string) (Store, error) {
+	driversMu.RLock()
+	driver, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ErrUnknownDriver, name)
+	}
+	return driver(), nil
+}
+
+// context bounds ctx by the database's default timeout.  Callers that need
+// longer pass a context with an earlier deadline or set Timeout to 0.
+func (db *Database) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.Timeout > 0 {
+		return context.WithTimeout(ctx, db.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Tables returns the names of the tables created through the database.
+func (db *Database) Tables() []string {
+	names := make([]string, 0)
+	if db.tables == nil {
+		return names
+	}
+	db.tables.mu.RLock()
+	for name := range db.tables.names {
+		names = append(names, name)
+	}
+	db.tables.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// checkTable fails with a *TableError unless table was created through the
+// database.
+func (db *Database) checkTable(table string) error {
+	if !ValidTable(table) {
+		return &TableError{Table: table, Invalid: true}
+	}
+	if db.tables != nil {
+		db.tables.mu.RLock()
+		known := db.tables.names[table]
+		db.tables.mu.RUnlock()
+		if known {
+			return nil
 		}
-		if err := json.Unmarshal(blob, &data); err != nil {
+	}
+	return &TableError{Table: table}
+}
+
+func (db *Database) GetAllObjs(ctx context.Context, table string) ([]interface{}, error) {
+	if err := db.checkTable(table); err != nil {
+		return nil, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	records, err := db.all(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		var value interface{}
+		if err := json.Unmarshal(record.Data, &value); err != nil {
 			return nil, err
 		}
+		data = append(data, value)
 	}
 	return data, nil
 }
 
-func (db *Database) DeleteObj(table string, key string) error {
-	if db.Name == "riak" {
-		if _, exists := db.Buckets[table]; !exists {
-			return errors.New("Bucket does not exist.")
-		}
-		if err := db.Buckets[table].Delete(key); err != nil {
+// Each calls fn with every record of table, streaming them from drivers that
+// implement Scanner.  It is not bounded by the database's timeout, so that
+// large tables can be read in full.
+func (db *Database) Each(ctx context.Context, table string, fn func(record *Record) error) error {
+	if err := db.checkTable(table); err != nil {
+		return err
+	}
+	if scanner, ok := db.Store.(Scanner); ok {
+		return scanner.Scan(ctx, table, fn)
+	}
+	records, err := db.Store.All(ctx, table)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		if err := fn(&records[i]); err != nil {
 			return err
 		}
-	} else {
-		query := ""
-		if db.Name == "postgres" {
-			query = fmt.Sprintf("DELETE FROM %s WHERE hash = $1", table)
-		} else {
-			query = fmt.Sprintf("DELETE FROM %s WHERE hash = ?", table)
+	}
+	return nil
+}
+
+// Query returns the objects of table selected by q, and the cursor for the
+// next page if q has a limit and more objects remain.
+func (db *Database) Query(ctx context.Context, table string, q *Query) ([]interface{}, string, error) {
+	records, next, err := db.QueryRecords(ctx, table, q)
+	if err != nil {
+		return nil, "", err
+	}
+	data := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		var value interface{}
+		if err := json.Unmarshal(record.Data, &value); err != nil {
+			return nil, "", err
 		}
-		if _, err := db.Connection.Exec(query, key); err != nil {
-			return err
+		data = append(data, value)
+	}
+	return data, next, nil
+}
+
+func (db *Database) QueryRecords(ctx context.Context, table string, q *Query) ([]Record, string, error) {
+	if err := db.checkTable(table); err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	var (
+		records []Record
+		err     error
+	)
+	if err := q.Validate(); err != nil {
+		return nil, "", err
+	}
+	limited := *q
+	if q.Limit > 0 {
+		limited.Limit = q.Limit + 1
+	}
+	if querier, ok := db.Store.(Querier); ok {
+		records, err = querier.Query(ctx, table, &limited)
+	} else if records, err = db.all(ctx, table); err == nil {
+		records, err = queryRecords(records, &limited)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if q.Limit == 0 || len(records) <= q.Limit {
+		return records, "", nil
+	}
+	records = records[:q.Limit]
+	next, err := q.cursor(&records[q.Limit-1])
+	if err != nil {
+		return nil, "", err
+	}
+	return records, next, nil
+}
+
+func (db *Database) GetObj(ctx context.Context, table string, key string) (interface{}, error) {
+	data, _, err := db.GetObjVersion(ctx, table, key)
+	return data, err
+}
+
+func (db *Database) GetObjVersion(ctx context.Context, table string, key string) (interface{}, int64, error) {
+	if err := db.checkTable(table); err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	var data interface{}
+	record, err := db.get(ctx, table, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(record.Data, &data); err != nil {
+		return nil, 0, err
+	}
+	return data, record.Version, nil
+}
+
+func (db *Database) DeleteObj(ctx context.Context, table string, key string) error {
+	return db.DeleteObjVersion(ctx, table, key, 0)
+}
+
+func (db *Database) DeleteObjVersion(ctx context.Context, table string, key string, version int64) error {
+	if err := db.checkTable(table); err != nil {
+		return err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	var err error
+	if policy := db.Policy(table); policy != nil && policy.SoftDelete {
+		err = db.softDelete(ctx, table, key, version)
+	} else {
+		err = db.Store.Delete(ctx, table, key, version)
+	}
+	if err != nil {
+		if err == ErrConflict {
+			db.Cache.Invalidate(table, key)
 		}
+		return err
 	}
+	db.emitChange("deleted", table, key, 0, nil)
 	return nil
 }
 
-func (db *Database) InsertObj(table string, key string, data interface{}) error {
+func (db *Database) InsertObj(ctx context.Context, table string, key string, data interface{}) error {
+	if err := db.checkTable(table); err != nil {
+		return err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
 	blob, err := json.Marshal(&data)
 	if err != nil {
 		return err
 	}
-	if db.Name == "riak" {
-		if _, exists := db.Buckets[table]; !exists {
-			return errors.New("Bucket does not exist.")
-		}
-		obj := db.Buckets[table].NewObject(key)
-		obj.ContentType = "application/json"
-		obj.Data = blob
-		if err = obj.Store(); err != nil {
-			return err
+	if err := db.checkUnique(ctx, table, key, blob); err != nil {
+		return err
+	}
+	if _, err := db.write(ctx, "insert", table, key, blob, 0); err != nil {
+		return err
+	}
+	db.emitChange("created", table, key, 1, blob)
+	return nil
+}
+
+func (db *Database) UpdateObj(ctx context.Context, table string, key string, data interface{}) error {
+	_, err := db.UpdateObjVersion(ctx, table, key, data, 0)
+	return err
+}
+
+func (db *Database) UpdateObjVersion(ctx context.Context, table string, key string, data interface{}, version int64) (int64, error) {
+	if err := db.checkTable(table); err != nil {
+		return 0, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.checkUnique(ctx, table, key, blob); err != nil {
+		return 0, err
+	}
+	next, err := db.write(ctx, "update", table, key, blob, version)
+	if err != nil {
+		if err == ErrConflict {
+			db.Cache.Invalidate(table, key)
 		}
+		return 0, err
+	}
+	db.emitChange("updated", table, key, next, blob)
+	return next, nil
+}
+
+func (db *Database) UpsertObj(ctx context.Context, table string, key string, data interface{}) error {
+	if err := db.checkTable(table); err != nil {
+		return err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	blob, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	if err := db.checkUnique(ctx, table, key, blob); err != nil {
+		return err
+	}
+	version, err := db.write(ctx, "upsert", table, key, blob, 0)
+	if err != nil {
+		return err
+	}
+	if version == 1 {
+		db.emitChange("created", table, key, version, blob)
 	} else {
-		query := ""
-		if db.Name == "postgres" {
-			query = fmt.Sprintf("INSERT INTO %s (hash, data) VALUES ($1, $2)", table)
+		db.emitChange("updated", table, key, version, blob)
+	}
+	return nil
+}
+
+// PatchObj applies patch to the stored object as a JSON merge patch (RFC
+// 7386): objects are merged recursively and null values remove fields.  The
+// write is conditional on the version that was read, and is retried a few
+// times if another writer got there first.
+func (db *Database) PatchObj(ctx context.Context, table string, key string, patch interface{}) (interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		merged, _, err := db.PatchObjVersion(ctx, table, key, patch, 0)
+		if err != ErrConflict || attempt == 2 {
+			return merged, err
+		}
+	}
+}
+
+// PatchObjVersion is PatchObj failing with ErrConflict unless the stored
+// object has the given version.  A version of 0 uses the version read.
+func (db *Database) PatchObjVersion(ctx context.Context, table string, key string, patch interface{}, version int64) (interface{}, int64, error) {
+	current, stored, err := db.GetObjVersion(ctx, table, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version != 0 && version != stored {
+		return nil, 0, ErrConflict
+	}
+	blob, err := json.Marshal(&patch)
+	if err != nil {
+		return nil, 0, err
+	}
+	var changes interface{}
+	if err := json.Unmarshal(blob, &changes); err != nil {
+		return nil, 0, err
+	}
+	merged := mergePatch(current, changes)
+	next, err := db.UpdateObjVersion(ctx, table, key, merged, stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	return merged, next, nil
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	fields, ok := target.(map[string]interface{})
+	if !ok {
+		fields = make(map[string]interface{})
+	}
+	for key, val := range changes {
+		if val == nil {
+			delete(fields, key)
 		} else {
-			query = fmt.Sprintf("INSERT INTO %s (hash, data) VALUES (?, ?)", table)
+			fields[key] = mergePatch(fields[key], val)
 		}
-		if _, err := db.Connection.Exec(query, key, blob); err != nil {
-			return err
+	}
+	return fields
+}
+
+// Tx runs fn inside a transaction, committing if it returns nil and rolling
+// back if it returns an error or panics.  The database's default timeout
+// applies to the whole transaction, and changes made in it are published
+// once it commits.  Use In to work with objects rather
+// than raw records inside fn.
+func (db *Database) Tx(ctx context.Context, fn func(tx Store) error) error {
+	transactor, ok := db.Store.(Transactor)
+	if !ok {
+		return ErrNoTx
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	tx, err := transactor.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	changes := &changeLog{}
+	pendingChanges.Store(tx, changes)
+	defer pendingChanges.Delete(tx)
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, change := range changes.changes {
+		db.Cache.Invalidate(change.Table, change.Key)
+		if db.Application != nil {
+			db.Application.PublishChange(change)
 		}
 	}
 	return nil
 }
 
-func (db *Database) Start() {
+// In returns a copy of db that runs its operations against store, typically
+// the transaction passed to a Tx callback.
+func (db *Database) In(store Store) *Database {
+	copied := *db
+	copied.Store = store
+	return &copied
+}
+
+// CreateTable creates table if it does not exist yet and adds it to the
+// tables the database accepts.
+func (db *Database) CreateTable(ctx context.Context, table string) error {
+	if !ValidTable(table) {
+		return &TableError{Table: table, Invalid: true}
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	if err := db.Store.CreateTable(ctx, table); err != nil {
+		return err
+	}
+	if db.tables == nil {
+		db.tables = newTableSet()
+	}
+	db.tables.mu.Lock()
+	db.tables.names[table] = true
+	db.tables.mu.Unlock()
+	return nil
+}
+
+// Health reports whether the database can be reached.
+func (db *Database) Health(ctx context.Context) error {
+	pinger, ok := db.Store.(Pinger)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return pinger.Ping(ctx)
+}
+
+// Start opens the store and creates the configured tables and indexes.  The
+// store is closed again if any of it fails.
+func (db *Database) Start() error {
+	if err := db.start(); err != nil {
+		db.Store.Close()
+		return err
+	}
+	return nil
+}
+
+// Close stops the reaper and closes the store.
+func (db *Database) Close() error {
+	if db.stopReaper != nil {
+		db.stopReaper()
+	}
+	return db.Store.Close()
+}
+
+func (db *Database) start() error {
 	usersTableExists := false
-	if db.Name == "riak" {
-		if err := riak.ConnectClient(db.Dsn); err != nil {
-			log.Fatal("Cannot connect, is Riak running?")
-		}
-		tableList := strings.Split(db.Params["tables"], ",")
-		for _, table := range tableList {
-			bname := strings.TrimSpace(table)
-			if bname == "users" {
-				usersTableExists = true
-			}
-			db.Buckets[bname], _ = riak.NewBucket(bname)
-		}
-		if usersTableExists == false {
-			db.Buckets["users"], _ = riak.NewBucket("users")
-		}
-	} else {
-		dbconn, err := sql.Open(db.Name, db.Dsn)
+	db.Timeout = defaultTimeout
+	if val, ok := db.Params["timeout"]; ok {
+		timeout, err := time.ParseDuration(val)
 		if err != nil {
-			log.Fatal(err)
-		}
-		db.Connection = dbconn
-		if _, exists := db.Params["tables"]; !exists {
-			return
+			return fmt.Errorf("Invalid database timeout: %s", val)
 		}
+		db.Timeout = timeout
+	}
+	// Opening is not bounded by the timeout, since SQL drivers keep retrying
+	// until the server answers.
+	if err := db.Store.Open(context.Background(), db.Params); err != nil {
+		return err
+	}
+	ctx, cancel := db.context(context.Background())
+	defer cancel()
+	if _, exists := db.Params["tables"]; exists {
 		tableList := strings.Split(db.Params["tables"], ",")
 		for _, table := range tableList {
 			tname := strings.TrimSpace(table)
 			if tname == "users" {
 				usersTableExists = true
 			}
-			statement := fmt.Sprintf(db.Create, tname)
-			if _, err := db.Connection.Exec(statement); err != nil {
-				log.Fatal(err)
+			if err := db.CreateTable(ctx, tname); err != nil {
+				return err
 			}
 		}
-		if usersTableExists == false {
-			statement := fmt.Sprintf(db.Create, "users")
-			if _, err := db.Connection.Exec(statement); err != nil {
-				log.Fatal(err)
-			}
+	}
+	if usersTableExists == false {
+		if err := db.CreateTable(ctx, "users"); err != nil {
+			return err
 		}
 	}
+	indexes, err := ParseIndexes(db.Params["indexes"])
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := db.CreateTable(ctx, index.Table); err != nil {
+			return err
+		}
+		if err := db.CreateIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+	if db.Params["migrate"] == "true" {
+		if err := db.MigrateUp(context.Background(), 0, false, log.Writer()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,276 @@
+//    Title: expiry.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultReapInterval = time.Minute
+
+// TablePolicy sets how the objects of a table age.  With a TTL an object
+// expires that long after it was last written.  With SoftDelete deleting an
+// object leaves a tombstone behind that can be restored, until it is reaped
+// TombstoneTTL after the delete, or never if TombstoneTTL is 0.
+type TablePolicy struct {
+	TTL          time.Duration
+	SoftDelete   bool
+	TombstoneTTL time.Duration
+}
+
+// ParseTablePolicy reads a policy from config.json: ttl and tombstone_ttl,
+// e.g. 24h, and soft_delete.
+func ParseTablePolicy(params map[string]string) (*TablePolicy, error) {
+	policy := &TablePolicy{SoftDelete: params["soft_delete"] == "true"}
+	durations := map[string]*time.Duration{
+		"ttl":           &policy.TTL,
+		"tombstone_ttl": &policy.TombstoneTTL,
+	}
+	for key, dest := range durations {
+		if val, ok := params[key]; ok {
+			duration, err := time.ParseDuration(val)
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf("Invalid retention value for %s: %s", key, val)
+			}
+			*dest = duration
+		}
+	}
+	return policy, nil
+}
+
+func (db *Database) expirer() (Expirer, error) {
+	if expirer, ok := db.Store.(Expirer); ok {
+		return expirer, nil
+	}
+	return nil, ErrNoExpiry
+}
+
+// SetTablePolicy applies policy to table, or removes its policy if nil.  It
+// fails with ErrNoExpiry for drivers that do not implement Expirer, and with
+// ErrBlobPolicy for a TTL or soft delete on a table holding blobs.
+func (db *Database) SetTablePolicy(table string, policy *TablePolicy) error {
+	if !ValidTable(table) {
+		return &TableError{Table: table, Invalid: true}
+	}
+	if _, err := db.expirer(); err != nil && policy != nil {
+		return err
+	}
+	if db.tables == nil {
+		db.tables = newTableSet()
+	}
+	db.tables.mu.Lock()
+	defer db.tables.mu.Unlock()
+	if policy != nil && (policy.TTL > 0 || policy.SoftDelete) && db.tables.blobs[table] {
+		return ErrBlobPolicy
+	}
+	if policy == nil {
+		delete(db.tables.policies, table)
+	} else {
+		db.tables.policies[table] = policy
+	}
+	return nil
+}
+
+// Policy returns the policy of table, or nil if it has none.
+func (db *Database) Policy(table string) *TablePolicy {
+	if db.tables == nil {
+		return nil
+	}
+	db.tables.mu.RLock()
+	defer db.tables.mu.RUnlock()
+	return db.tables.policies[table]
+}
+
+// write runs the insert, update or upsert named by op.  For tables with a TTL
+// it restarts the object's expiry in the same write, so an object is never
+// stored without one.
+func (db *Database) write(ctx context.Context, op string, table string, key string, blob []byte, version int64) (int64, error) {
+	var (
+		next int64
+		err  error
+	)
+	if policy := db.Policy(table); policy != nil && policy.TTL > 0 {
+		expirer, err := db.expirer()
+		if err != nil {
+			return 0, err
+		}
+		next, err = expirer.WriteExpiring(ctx, op, table, key, blob, version, unixMillis(time.Now().Add(policy.TTL)))
+		return next, db.uniqueError(table, err)
+	}
+	switch op {
+	case "insert":
+		next, err = 1, db.Store.Insert(ctx, table, key, blob)
+	case "update":
+		next, err = db.Store.Update(ctx, table, key, blob, version)
+	default:
+		next, err = db.Store.Upsert(ctx, table, key, blob)
+	}
+	return next, db.uniqueError(table, err)
+}
+
+func (db *Database) softDelete(ctx context.Context, table string, key string, version int64) error {
+	expirer, err := db.expirer()
+	if err != nil {
+		return err
+	}
+	return expirer.SoftDelete(ctx, table, key, version)
+}
+
+// Expire makes the object of key expire ttl from now, or never for 0.  It
+// replaces the TTL of the table's policy until the object is written again.
+func (db *Database) Expire(ctx context.Context, table string, key string, ttl time.Duration) error {
+	if err := db.checkTable(table); err != nil {
+		return err
+	}
+	expirer, err := db.expirer()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	expires := int64(0)
+	if ttl > 0 {
+		expires = unixMillis(time.Now().Add(ttl))
+	}
+	if err := expirer.Expire(ctx, table, key, expires); err != nil {
+		return err
+	}
+	db.Cache.Invalidate(table, key)
+	return nil
+}
+
+// Restore brings back an object that was soft deleted and publishes it as
+// created.  It fails with ErrNotFound if there is no tombstone for key.
+func (db *Database) Restore(ctx context.Context, table string, key string) (int64, error) {
+	if err := db.checkTable(table); err != nil {
+		return 0, err
+	}
+	expirer, err := db.expirer()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	version, err := expirer.Restore(ctx, table, key)
+	if err != nil {
+		return 0, err
+	}
+	record, err := db.Store.Get(ctx, table, key)
+	if err != nil {
+		return 0, err
+	}
+	db.emitChange("created", table, key, version, record.Data)
+	return version, nil
+}
+
+// Tombstones returns the soft deleted objects of table.
+func (db *Database) Tombstones(ctx context.Context, table string) ([]Record, error) {
+	if err := db.checkTable(table); err != nil {
+		return nil, err
+	}
+	expirer, err := db.expirer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return expirer.Tombstones(ctx, table)
+}
+
+// Reap removes the expired objects of every table, and the tombstones older
+// than their table's TombstoneTTL, and returns how many were removed.
+// Expired objects are already hidden from reads, so reaping only frees space
+// and publishes no changes.
+func (db *Database) Reap(ctx context.Context) (int, error) {
+	expirer, err := db.expirer()
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, table := range db.Tables() {
+		before := int64(0)
+		if policy := db.Policy(table); policy != nil && policy.TombstoneTTL > 0 {
+			before = unixMillis(time.Now().Add(-policy.TombstoneTTL))
+		}
+		tctx, cancel := db.context(ctx)
+		count, err := expirer.Reap(tctx, table, before)
+		cancel()
+		reaped += count
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// StartReaper reaps the database every reap_interval (default is 1m) in the
+// background, until Close.  It does nothing for drivers that do not implement
+// Expirer or when reap_interval is 0.
+func (db *Database) StartReaper() error {
+	interval := defaultReapInterval
+	if val, ok := db.Params["reap_interval"]; ok {
+		duration, err := time.ParseDuration(val)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("Invalid database value for reap_interval: %s", val)
+		}
+		interval = duration
+	}
+	if _, err := db.expirer(); err != nil || interval == 0 {
+		return nil
+	}
+	if db.stopReaper != nil {
+		db.stopReaper()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	db.stopReaper = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := db.Reap(ctx); err != nil && ctx.Err() == nil {
+					log.Println("error reaping ", db.Name, ": ", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// configureRetention applies the retention section of config.json.
+func (a *App) configureRetention() error {
+	for name, params := range a.Retention {
+		db, table, err := a.TableNamed(name)
+		if err != nil {
+			return err
+		}
+		policy, err := ParseTablePolicy(params)
+		if err != nil {
+			return err
+		}
+		if err := db.SetTablePolicy(table, policy); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
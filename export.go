@@ -0,0 +1,164 @@
+//    Title: export.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// importBatch is how many records Import writes per transaction.
+const importBatch = 500
+
+// ExportRecord is one line of an export: the object's key and its JSON, the
+// same hash and data every driver stores.
+type ExportRecord struct {
+	Hash string          `json:"hash"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Export writes every object of table to w as JSON Lines and returns how many
+// were written.  Records are streamed from drivers that implement Scanner.
+func (db *Database) Export(ctx context.Context, table string, w io.Writer) (int, error) {
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	count := 0
+	err := db.Each(ctx, table, func(record *Record) error {
+		if err := encoder.Encode(&ExportRecord{Hash: record.Key, Data: record.Data}); err != nil {
+			return &DecodeError{Table: table, Key: record.Key, Err: err}
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+// Import reads JSON Lines written by Export from r and stores each object in
+// table, replacing objects with the same key.  Records are written in batches,
+// each in one transaction on drivers that have them, so a failed import leaves
+// the batches before the failing one behind.  Import returns how many records
+// were stored.
+func (db *Database) Import(ctx context.Context, table string, r io.Reader) (int, error) {
+	if err := db.checkTable(table); err != nil {
+		return 0, err
+	}
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	batch := make([]*ExportRecord, 0, importBatch)
+	count := 0
+	for {
+		record := &ExportRecord{}
+		err := decoder.Decode(record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("Record %d: %s", count+len(batch)+1, err)
+		}
+		if record.Hash == "" || len(record.Data) == 0 {
+			return count, fmt.Errorf("Record %d: A hash and data are required.", count+len(batch)+1)
+		}
+		if batch = append(batch, record); len(batch) == importBatch {
+			if err := db.importBatch(ctx, table, batch); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := db.importBatch(ctx, table, batch); err != nil {
+		return count, err
+	}
+	return count + len(batch), nil
+}
+
+func (db *Database) importBatch(ctx context.Context, table string, batch []*ExportRecord) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	upsert := func(db *Database) error {
+		for _, record := range batch {
+			if err := db.UpsertObj(ctx, table, record.Hash, record.Data); err != nil {
+				return fmt.Errorf("Record %s: %s", record.Hash, err)
+			}
+		}
+		return nil
+	}
+	err := db.Tx(ctx, func(tx Store) error {
+		return upsert(db.In(tx))
+	})
+	if err == ErrNoTx {
+		return upsert(db)
+	}
+	return err
+}
+
+// ExportCommand runs the export command line, writing the table named by
+// -table in the default database, or the one named by -db, to out.
+func (a *App) ExportCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	table := flags.String("table", "", "The table to export.")
+	dbname := flags.String("db", "", "The database to export from (default is the default database).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *table == "" {
+		return errors.New("Usage: export -table name [-db name]")
+	}
+	db, err := a.commandDatabase(*dbname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.CreateTable(context.Background(), *table); err != nil {
+		return err
+	}
+	_, err = db.Export(context.Background(), *table, out)
+	return err
+}
+
+// ImportCommand runs the import command line, reading records from in into
+// the table named by -table in the default database, or the one named by -db,
+// and reporting the count to out.
+func (a *App) ImportCommand(args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	table := flags.String("table", "", "The table to import into.")
+	dbname := flags.String("db", "", "The database to import into (default is the default database).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *table == "" {
+		return errors.New("Usage: import -table name [-db name]")
+	}
+	db, err := a.commandDatabase(*dbname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.CreateTable(context.Background(), *table); err != nil {
+		return err
+	}
+	count, err := db.Import(context.Background(), *table, in)
+	fmt.Fprintf(out, "Imported %d records into %s.\n", count, *table)
+	return err
+}
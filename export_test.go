@@ -0,0 +1,101 @@
+//    Title: export_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func exportDatabase(t *testing.T, driver string) *Database {
+	t.Helper()
+	db, err := NewApp().NewDatabase(driver, testStoreParams[driver](t.TempDir()))
+	mustStore(t, err)
+	t.Cleanup(func() { db.Close() })
+	mustStore(t, db.CreateTable(context.Background(), "posts"))
+	return db
+}
+
+func exportedRecords(t *testing.T, db *Database) []string {
+	t.Helper()
+	records, err := db.Store.All(context.Background(), "posts")
+	mustStore(t, err)
+	lines := make([]string, len(records))
+	for i, record := range records {
+		lines[i] = record.Key + " " + string(record.Data)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// TestExportImport moves a table larger than an import batch between every
+// pair of drivers and checks the objects arrive unchanged.
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	for from := range testStoreParams {
+		for to := range testStoreParams {
+			t.Run(from+"/"+to, func(t *testing.T) {
+				src, dst := exportDatabase(t, from), exportDatabase(t, to)
+				for i := 0; i < importBatch+2; i++ {
+					mustStore(t, src.InsertObj(ctx, "posts", fmt.Sprintf("k%04d", i), map[string]interface{}{"n": i, "text": "line\nbreak \"quoted\""}))
+				}
+				mustStore(t, dst.InsertObj(ctx, "posts", "k0000", map[string]interface{}{"n": "replaced"}))
+				var out bytes.Buffer
+				count, err := src.Export(ctx, "posts", &out)
+				mustStore(t, err)
+				if count != importBatch+2 || strings.Count(out.String(), "\n") != count {
+					t.Fatalf("exported %d records in %d lines", count, strings.Count(out.String(), "\n"))
+				}
+				count, err = dst.Import(ctx, "posts", &out)
+				mustStore(t, err)
+				if count != importBatch+2 {
+					t.Fatalf("imported %d records, want %d", count, importBatch+2)
+				}
+				want, got := exportedRecords(t, src), exportedRecords(t, dst)
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Fatalf("imported %d records that differ from the %d exported", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"invalid JSON", `{"hash":"a","data":{}}` + "\n{\n", "Record 2:"},
+		{"no hash", `{"data":{"n":1}}`, "Record 1: A hash and data are required."},
+		{"no data", `{"hash":"a"}`, "Record 1: A hash and data are required."},
+	}
+	for _, test := range tests {
+		db := exportDatabase(t, "memory")
+		count, err := db.Import(context.Background(), "posts", strings.NewReader(test.input))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.err)
+		}
+		if records := exportedRecords(t, db); count != 0 || len(records) != 0 {
+			t.Errorf("%s: imported %d and stored %v from a partial batch", test.name, count, records)
+		}
+	}
+}
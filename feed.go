@@ -0,0 +1,161 @@
+//    Title: feed.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+)
+
+// feedPrefix starts the names of the rooms that follow a feed: clients join
+// "feed:posts" for every change to posts, or "feed:posts/42" for one object.
+const feedPrefix = "feed:"
+
+// Change describes a write to a table.  Op is created, updated or deleted,
+// and Data holds the object as written, or nothing for deletes.
+type Change struct {
+	Op      string          `json:"op"`
+	DB      string          `json:"db,omitempty"`
+	Table   string          `json:"table"`
+	Key     string          `json:"key"`
+	Version int64           `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type changeLog struct {
+	mu      sync.Mutex
+	changes []*Change
+}
+
+// pendingChanges holds the changes made inside each open transaction, which
+// are only published once it commits.
+var pendingChanges sync.Map
+
+// Feed returns the name of the feed for the changed table, in the form read
+// by TableNamed.
+func (change *Change) Feed() string {
+	if change.DB != "" {
+		return change.DB + "." + change.Table
+	}
+	return change.Table
+}
+
+// external reports whether db is not the application's default database.
+func (db *Database) external() bool {
+	return db.Application != nil && (db.Application.DB == nil || db.Application.DB.Name != db.Name)
+}
+
+// feed returns the name of the feed following table.
+func (db *Database) feed(table string) string {
+	if db.external() {
+		return db.Name + "." + table
+	}
+	return table
+}
+
+// emitChange invalidates the cached copy of the object and publishes the
+// change, or holds it back until the transaction it was made in commits.
+func (db *Database) emitChange(op string, table string, key string, version int64, blob []byte) {
+	db.Cache.Invalidate(table, key)
+	change := &Change{Op: op, Table: table, Key: key, Version: version, Data: blob}
+	if db.external() {
+		change.DB = db.Name
+	}
+	if pending, ok := pendingChanges.Load(db.Store); ok {
+		changes := pending.(*changeLog)
+		changes.mu.Lock()
+		changes.changes = append(changes.changes, change)
+		changes.mu.Unlock()
+		return
+	}
+	if db.Application != nil {
+		db.Application.PublishChange(change)
+	}
+}
+
+// Subscribe sends the changes of feed to room.  A feed is a table, or a table
+// and key separated by a slash for a single object.
+func (a *App) Subscribe(room string, feed string) {
+	a.feedsMu.Lock()
+	defer a.feedsMu.Unlock()
+	if _, ok := a.feeds[feed]; !ok {
+		a.feeds[feed] = make(map[string]bool)
+	}
+	a.feeds[feed][room] = true
+}
+
+func (a *App) Unsubscribe(room string, feed string) {
+	a.feedsMu.Lock()
+	defer a.feedsMu.Unlock()
+	delete(a.feeds[feed], room)
+	if len(a.feeds[feed]) == 0 {
+		delete(a.feeds, feed)
+	}
+}
+
+// PublishChange emits change on the Emitter as "change" and sends it as a
+// created, updated or deleted event to the feed rooms of its table and key
+// and to the rooms subscribed to them.
+func (a *App) PublishChange(change *Change) {
+	a.Emitter.Emit("change", change)
+	a.refreshViews(change)
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.Println("error encoding change: ", err)
+		return
+	}
+	rooms := make(map[string]bool)
+	a.feedsMu.RLock()
+	for _, feed := range []string{change.Feed(), change.Feed() + "/" + change.Key} {
+		rooms[feedPrefix+feed] = true
+		for room := range a.feeds[feed] {
+			rooms[room] = true
+		}
+	}
+	a.feedsMu.RUnlock()
+	for name := range rooms {
+		room := a.room(name)
+		if room == nil {
+			continue
+		}
+		msg := &Message{
+			RoomLength:    len(name),
+			Room:          name,
+			EventLength:   len(change.Op),
+			Event:         change.Op,
+			DstLength:     0,
+			Dst:           "",
+			SrcLength:     0,
+			Src:           "",
+			PayloadLength: len(payload),
+			Payload:       payload,
+		}
+		room.Emit(nil, MessageToBytes(msg))
+	}
+}
+
+// canFollow reports whether user may join the feed room name, which needs
+// read access to the feed's table.  Other rooms are open to everyone.
+func (a *App) canFollow(name string, user *User) bool {
+	if !strings.HasPrefix(name, feedPrefix) {
+		return true
+	}
+	feed := strings.SplitN(strings.TrimPrefix(name, feedPrefix), "/", 2)[0]
+	return a.CanAccess(feed, "read", user)
+}
@@ -0,0 +1,472 @@
+//    Title: file.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const defaultCompactAfter = 1000
+
+// FileStore keeps every table in memory and appends each change to a log
+// file.  Each line of the log holds a CRC32 checksum followed by one JSON
+// entry, so a line torn by a crash is detected and dropped when the log is
+// replayed.  Once enough entries have been superseded the log is compacted by
+// writing the live records to a temporary file and renaming it into place.
+type FileStore struct {
+	*MemoryStore
+	Path         string
+	Sync         bool
+	CompactAfter int
+	file         *os.File
+	size         int64
+	failed       error
+	dead         int
+	mu           sync.Mutex
+}
+
+type fileEntry struct {
+	Op      string          `json:"op"`
+	Table   string          `json:"table"`
+	Key     string          `json:"key,omitempty"`
+	Version int64           `json:"version,omitempty"`
+	Expires int64           `json:"expires,omitempty"`
+	Deleted int64           `json:"deleted,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func init() {
+	RegisterDriver("file", func() Store {
+		return &FileStore{MemoryStore: NewMemoryStore()}
+	})
+}
+
+func encodeEntry(entry *fileEntry) ([]byte, error) {
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	line := []byte(fmt.Sprintf("%08x ", crc32.ChecksumIEEE(blob)))
+	line = append(line, blob...)
+	return append(line, '\n'), nil
+}
+
+func decodeEntry(line []byte) (*fileEntry, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return nil, errors.New("Malformed log entry.")
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(line[9:]) {
+		return nil, errors.New("Corrupt log entry.")
+	}
+	entry := &fileEntry{}
+	if err := json.Unmarshal(line[9:], entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *FileStore) Open(ctx context.Context, params map[string]string) error {
+	s.Path = params["file"]
+	if s.Path == "" {
+		s.Path = "rtgo.db"
+	}
+	s.Sync = params["sync"] != "false"
+	s.CompactAfter = defaultCompactAfter
+	if val, ok := params["compact_after"]; ok {
+		num, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("Invalid compact_after value: %s", val)
+		}
+		s.CompactAfter = num
+	}
+	size, corrupt, err := s.replay()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.size = size
+	if corrupt {
+		return s.compact()
+	}
+	return nil
+}
+
+// replay loads the log into memory and returns the length of its valid
+// part.  Lines that fail their checksum at the end of the log are the remains
+// of a write interrupted by a crash and are truncated.  A bad line followed
+// by valid entries is not: the entries after it are still applied, every bad
+// line is logged, the log is kept as Path.corrupt and replay reports that it
+// must be compacted to leave the bad lines behind.
+func (s *FileStore) replay() (int64, bool, error) {
+	file, err := os.OpenFile(s.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	offset, valid := int64(0), int64(0)
+	bad := make([]int64, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		entry, decodeErr := decodeEntry(line)
+		if err == nil && decodeErr != nil {
+			// A torn write has no newline, so the entry appended after it
+			// shares its line.
+			if at := entryStart(line); at > 0 {
+				bad = append(bad, offset)
+				entry, decodeErr = decodeEntry(line[at:])
+			}
+		}
+		if err == io.EOF || decodeErr != nil {
+			bad = append(bad, offset)
+		} else {
+			s.apply(entry)
+			valid = offset + int64(len(line))
+		}
+		offset += int64(len(line))
+	}
+	if len(bad) == 0 || bad[0] >= valid {
+		if valid < offset {
+			log.Println("truncating interrupted write at offset ", valid, " of ", s.Path)
+		}
+		return valid, false, file.Truncate(valid)
+	}
+	for _, at := range bad {
+		log.Println("skipping corrupt entry at offset ", at, " of ", s.Path)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	backup, err := os.OpenFile(s.Path+".corrupt", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, false, err
+	}
+	_, err = io.Copy(backup, file)
+	if closeErr := backup.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	log.Println("kept the corrupt log of ", s.Path, " as ", s.Path+".corrupt")
+	return offset, true, nil
+}
+
+// entryStart returns where a valid entry starts inside line after some
+// other bytes, or -1.
+func entryStart(line []byte) int {
+	for at := 1; at+10 <= len(line); at++ {
+		if line[at+8] != ' ' || line[at+9] != '{' {
+			continue
+		}
+		if _, err := strconv.ParseUint(string(line[at:at+8]), 16, 32); err != nil {
+			continue
+		}
+		if _, err := decodeEntry(line[at:]); err == nil {
+			return at
+		}
+	}
+	return -1
+}
+
+func (s *FileStore) apply(entry *fileEntry) {
+	s.MemoryStore.mu.Lock()
+	defer s.MemoryStore.mu.Unlock()
+	rows, exists := s.Tables[entry.Table]
+	if !exists {
+		rows = make(map[string]*Record)
+		s.Tables[entry.Table] = rows
+	}
+	switch entry.Op {
+	case "put":
+		if _, exists := rows[entry.Key]; exists {
+			s.dead++
+		}
+		version := entry.Version
+		if version == 0 {
+			version = 1
+		}
+		rows[entry.Key] = &Record{Key: entry.Key, Data: []byte(entry.Data), Version: version, Expires: entry.Expires, Deleted: entry.Deleted}
+	case "del":
+		if _, exists := rows[entry.Key]; exists {
+			delete(rows, entry.Key)
+			s.dead += 2
+		}
+	}
+}
+
+func (s *FileStore) write(entry *fileEntry) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	line, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(line)
+	if err == nil && s.Sync {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// A short or failed write can leave part of the line behind, which
+		// would sit in front of every later entry, so it is cut off.  If that
+		// fails too, no more writes are taken until a compaction rewrites the
+		// log.
+		if truncErr := s.file.Truncate(s.size); truncErr != nil {
+			s.failed = fmt.Errorf("File store stopped after a failed write: %s", err)
+		}
+		return err
+	}
+	s.size += int64(len(line))
+	s.apply(entry)
+	if s.CompactAfter > 0 && s.dead >= s.CompactAfter {
+		// The entry is already logged and applied, so a failed compaction
+		// only leaves the log longer than it needs to be.  It is tried again
+		// once as many more entries have been superseded.
+		if err := s.compact(); err != nil {
+			log.Println("error compacting file store: ", err)
+			s.dead = 0
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) CreateTable(ctx context.Context, table string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.mu.RLock()
+	_, exists := s.Tables[table]
+	s.MemoryStore.mu.RUnlock()
+	if exists {
+		return nil
+	}
+	return s.write(&fileEntry{Op: "table", Table: table})
+}
+
+func (s *FileStore) put(ctx context.Context, op string, table string, key string, data []byte, version int64, expires int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.mu.RLock()
+	record, err := s.next(op, table, key, version, expires)
+	s.MemoryStore.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.write(&fileEntry{Op: "put", Table: table, Key: key, Version: record.Version, Expires: record.Expires, Data: data}); err != nil {
+		return 0, err
+	}
+	return record.Version, nil
+}
+
+func (s *FileStore) Insert(ctx context.Context, table string, key string, data []byte) error {
+	_, err := s.put(ctx, "insert", table, key, data, 0, 0)
+	return err
+}
+
+func (s *FileStore) Update(ctx context.Context, table string, key string, data []byte, version int64) (int64, error) {
+	return s.put(ctx, "update", table, key, data, version, 0)
+}
+
+func (s *FileStore) Upsert(ctx context.Context, table string, key string, data []byte) (int64, error) {
+	return s.put(ctx, "upsert", table, key, data, 0, 0)
+}
+
+func (s *FileStore) Delete(ctx context.Context, table string, key string, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.mu.RLock()
+	rows, record, err := s.lookup(table, key)
+	_, stored := rows[key]
+	s.MemoryStore.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		if version != 0 {
+			return ErrNotFound
+		} else if !stored {
+			return nil
+		}
+	}
+	if version != 0 && record.Version != version {
+		return ErrConflict
+	}
+	return s.write(&fileEntry{Op: "del", Table: table, Key: key})
+}
+
+// update logs the record of key as op leaves it, in full, so that expiry
+// times and soft deletes survive a restart.
+func (s *FileStore) update(ctx context.Context, op string, table string, key string, version int64, expires int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.mu.RLock()
+	record, err := s.mark(op, table, key, version, expires)
+	s.MemoryStore.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	entry := &fileEntry{Op: "put", Table: table, Key: key, Version: record.Version, Expires: record.Expires, Deleted: record.Deleted, Data: record.Data}
+	if err := s.write(entry); err != nil {
+		return 0, err
+	}
+	return record.Version, nil
+}
+
+func (s *FileStore) WriteExpiring(ctx context.Context, op string, table string, key string, data []byte, version int64, expires int64) (int64, error) {
+	return s.put(ctx, op, table, key, data, version, expires)
+}
+
+func (s *FileStore) Expire(ctx context.Context, table string, key string, expires int64) error {
+	_, err := s.update(ctx, "expire", table, key, 0, expires)
+	return err
+}
+
+func (s *FileStore) SoftDelete(ctx context.Context, table string, key string, version int64) error {
+	_, err := s.update(ctx, "softdelete", table, key, version, 0)
+	return err
+}
+
+func (s *FileStore) Restore(ctx context.Context, table string, key string) (int64, error) {
+	return s.update(ctx, "restore", table, key, 0, 0)
+}
+
+func (s *FileStore) Reap(ctx context.Context, table string, before int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.mu.RLock()
+	keys, err := s.reapable(table, before)
+	s.MemoryStore.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := s.write(&fileEntry{Op: "del", Table: table, Key: key}); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact writes the live records to a temporary file and renames it over
+// the log.  The temporary file is opened for appending, so once it is in
+// place it becomes the log without being reopened; until then the old log
+// stays in use, and a failure leaves it as it was.
+func (s *FileStore) compact() error {
+	tmp, err := os.OpenFile(s.Path+".compact", os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(s.Path + ".compact")
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	size := int64(0)
+	s.MemoryStore.mu.RLock()
+	for table, rows := range s.Tables {
+		entries := []*fileEntry{{Op: "table", Table: table}}
+		for key, record := range rows {
+			entries = append(entries, &fileEntry{Op: "put", Table: table, Key: key, Version: record.Version, Expires: record.Expires, Deleted: record.Deleted, Data: record.Data})
+		}
+		for _, entry := range entries {
+			line, err := encodeEntry(entry)
+			if err == nil {
+				_, err = writer.Write(line)
+				size += int64(len(line))
+			}
+			if err != nil {
+				s.MemoryStore.mu.RUnlock()
+				return fail(err)
+			}
+		}
+	}
+	s.MemoryStore.mu.RUnlock()
+	if err := writer.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(s.Path+".compact", s.Path); err != nil {
+		return fail(err)
+	}
+	if dir, err := os.Open(filepath.Dir(s.Path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.file.Close()
+	s.file = tmp
+	s.size = size
+	s.failed = nil
+	s.dead = 0
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,501 @@
+//    Title: history.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	// maxHistoryBacklog caps how many messages are held while the database
+	// refuses writes; the oldest are dropped beyond it.
+	maxHistoryBacklog = 100000
+	// maxHistoryBackoff caps the wait between retries of a failed batch.
+	maxHistoryBackoff = time.Minute
+	// maxHistoryScan caps how many messages one search reads.
+	maxHistoryScan = 1000
+)
+
+// StoredMessage is a room broadcast as kept in the history table.  Time is in
+// milliseconds since the epoch.  Payloads that are JSON are stored as such,
+// anything else as Raw.
+type StoredMessage struct {
+	Id       string          `json:"id"`
+	Room     string          `json:"room"`
+	Event    string          `json:"event"`
+	Src      string          `json:"src,omitempty"`
+	Username string          `json:"username,omitempty"`
+	Time     int64           `json:"time"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Raw      []byte          `json:"raw,omitempty"`
+}
+
+// HistoryQuery selects the stored messages of a room, newest first.  Since
+// and Until bound Time, Event selects one event, and Search keeps messages
+// whose JSON payload holds a string containing it, ignoring case.
+type HistoryQuery struct {
+	Room   string `json:"room"`
+	Since  int64  `json:"since,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+	Event  string `json:"event,omitempty"`
+	Search string `json:"q,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+type HistoryResponse struct {
+	Status   string           `json:"status,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Room     string           `json:"room"`
+	Messages []*StoredMessage `json:"messages"`
+	Next     string           `json:"next,omitempty"`
+}
+
+// MessageStore writes the broadcasts of the rooms matching Rooms to Table.
+// Messages are queued and written in batches of BatchSize, or whatever has
+// gathered after FlushInterval.  A batch that fails is retried on the ticker,
+// waiting twice as long after each failure up to maxHistoryBackoff.
+type MessageStore struct {
+	Application   *App
+	DB            *Database
+	Table         string
+	Rooms         []string
+	BatchSize     int
+	FlushInterval time.Duration
+	queue         chan *StoredMessage
+	flushes       chan chan struct{}
+	dropped       int64
+	mu            sync.Mutex
+}
+
+func (a *App) NewMessageStore(params map[string]string) (*MessageStore, error) {
+	store := &MessageStore{
+		Application:   a,
+		Table:         "history",
+		Rooms:         splitList(params["rooms"]),
+		BatchSize:     100,
+		FlushInterval: time.Second,
+	}
+	if len(store.Rooms) == 0 {
+		return nil, fmt.Errorf("History needs a list of rooms.")
+	}
+	if val, ok := params["batch_size"]; ok {
+		num, err := strconv.Atoi(val)
+		if err != nil || num <= 0 {
+			return nil, fmt.Errorf("Invalid history value for batch_size: %s", val)
+		}
+		store.BatchSize = num
+	}
+	if val, ok := params["flush_interval"]; ok {
+		duration, err := time.ParseDuration(val)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("Invalid history value for flush_interval: %s", val)
+		}
+		store.FlushInterval = duration
+	}
+	if val, ok := params["table"]; ok {
+		store.Table = val
+	}
+	db, err := a.DBNamed(params["database"])
+	if err != nil {
+		return nil, err
+	}
+	store.DB = db
+	ctx := context.Background()
+	if err := db.CreateTable(ctx, store.Table); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"room", "time"} {
+		if err := db.CreateIndex(ctx, &Index{Table: store.Table, Field: field}); err != nil {
+			return nil, err
+		}
+	}
+	store.queue = make(chan *StoredMessage, 16*store.BatchSize)
+	store.flushes = make(chan chan struct{})
+	go store.run()
+	a.Messages = store
+	return store, nil
+}
+
+// Persists reports whether the broadcasts of room are stored.  Feed rooms
+// never are: their changes are already in the database.
+func (s *MessageStore) Persists(room string) bool {
+	return s != nil && !strings.HasPrefix(room, feedPrefix) && matchAny(s.Rooms, room)
+}
+
+// Record queues a broadcast of room for storage.  Membership events are not
+// kept.  Record never blocks the room: when the queue is full the message is
+// dropped and counted in Dropped.
+func (s *MessageStore) Record(room string, sender *Conn, data []byte) {
+	msg := BytesToMessage(data)
+	switch msg.Event {
+	case "join", "leave", "joined", "left":
+		return
+	}
+	now := time.Now()
+	stored := &StoredMessage{
+		Id:    fmt.Sprintf("%020d-%s", now.UnixNano(), uuid.NewV4().String()[:8]),
+		Room:  room,
+		Event: msg.Event,
+		Src:   msg.Src,
+		Time:  now.UnixNano() / int64(time.Millisecond),
+	}
+	if sender != nil {
+		stored.Username = sender.Username
+	}
+	if json.Valid(msg.Payload) {
+		stored.Payload = append(json.RawMessage(nil), msg.Payload...)
+	} else if len(msg.Payload) > 0 {
+		stored.Raw = append([]byte(nil), msg.Payload...)
+	}
+	select {
+	case s.queue <- stored:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns how many messages were not stored because the queue or the
+// backlog of a failing database was full.
+func (s *MessageStore) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Flush waits until every message queued so far has been written, or has
+// failed to be.
+func (s *MessageStore) Flush() {
+	done := make(chan struct{})
+	s.flushes <- done
+	<-done
+}
+
+func (s *MessageStore) run() {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*StoredMessage, 0, s.BatchSize)
+	var (
+		failures int
+		retry    time.Time
+		reported int64
+	)
+	flush := func(force bool) {
+		if len(batch) == 0 || (!force && time.Now().Before(retry)) {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			failures++
+			wait := s.backoff(failures)
+			retry = time.Now().Add(wait)
+			log.Println("error storing room history, retrying in ", wait, ": ", err)
+			return
+		}
+		failures = 0
+		retry = time.Time{}
+		batch = batch[:0]
+	}
+	keep := func(stored *StoredMessage) {
+		batch = append(batch, stored)
+		if len(batch) > maxHistoryBacklog {
+			batch = batch[len(batch)-maxHistoryBacklog:]
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+	for {
+		select {
+		case stored := <-s.queue:
+			keep(stored)
+			if len(batch) >= s.BatchSize && failures == 0 {
+				flush(false)
+			}
+		case <-ticker.C:
+			flush(false)
+			if dropped := s.Dropped(); dropped != reported {
+				log.Println("dropped ", dropped-reported, " messages from room history")
+				reported = dropped
+			}
+		case done := <-s.flushes:
+			for len(s.queue) > 0 {
+				keep(<-s.queue)
+			}
+			flush(true)
+			close(done)
+		}
+	}
+}
+
+// backoff returns how long to wait before retrying after failures failed
+// writes in a row.
+func (s *MessageStore) backoff(failures int) time.Duration {
+	wait := s.FlushInterval
+	for i := 1; i < failures && wait < maxHistoryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxHistoryBackoff {
+		wait = maxHistoryBackoff
+	}
+	return wait
+}
+
+// write stores batch, in one transaction where the driver has them.  Stored
+// messages publish no changes, so history can never feed itself.
+func (s *MessageStore) write(batch []*StoredMessage) error {
+	ctx := context.Background()
+	defer func() {
+		for _, stored := range batch {
+			s.DB.Cache.Invalidate(s.Table, stored.Id)
+		}
+	}()
+	insert := func(db *Database) error {
+		for _, stored := range batch {
+			blob, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			wctx, cancel := db.context(ctx)
+			_, err = db.write(wctx, "insert", s.Table, stored.Id, blob, 0)
+			cancel()
+			if err != nil && err != ErrExists {
+				return err
+			}
+		}
+		return nil
+	}
+	err := s.DB.Tx(ctx, func(tx Store) error {
+		return insert(s.DB.In(tx))
+	})
+	if err == ErrNoTx {
+		err = insert(s.DB)
+	}
+	return err
+}
+
+func (hq *HistoryQuery) query() *Query {
+	q := &Query{
+		Filters: []Filter{{Field: "room", Op: "eq", Value: hq.Room}},
+		Sort:    []Sort{{Field: "time", Desc: true}},
+		Limit:   hq.Limit,
+		After:   hq.After,
+	}
+	if hq.Since > 0 {
+		q.Filters = append(q.Filters, Filter{Field: "time", Op: "gte", Value: hq.Since})
+	}
+	if hq.Until > 0 {
+		q.Filters = append(q.Filters, Filter{Field: "time", Op: "lt", Value: hq.Until})
+	}
+	if hq.Event != "" {
+		q.Filters = append(q.Filters, Filter{Field: "event", Op: "eq", Value: hq.Event})
+	}
+	return q
+}
+
+func containsText(value interface{}, text string) bool {
+	switch value := value.(type) {
+	case string:
+		return strings.Contains(strings.ToLower(value), text)
+	case map[string]interface{}:
+		for _, field := range value {
+			if containsText(field, text) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if containsText(item, text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (stored *StoredMessage) matches(text string) bool {
+	if text == "" {
+		return true
+	}
+	var payload interface{}
+	if len(stored.Payload) == 0 || json.Unmarshal(stored.Payload, &payload) != nil {
+		return false
+	}
+	return containsText(payload, text)
+}
+
+// Search returns a page of the messages selected by hq and the cursor for the
+// next page.  Searching the payloads happens in memory, so it reads pages
+// until enough messages match, but no more than maxHistoryScan messages; a
+// page can then hold fewer than Limit messages and still have a cursor.
+func (s *MessageStore) Search(ctx context.Context, hq *HistoryQuery) ([]*StoredMessage, string, error) {
+	if hq.Room == "" {
+		return nil, "", fmt.Errorf("%s A room is required.", ErrBadQuery)
+	}
+	if hq.Limit <= 0 {
+		hq.Limit = defaultHistoryLimit
+	} else if hq.Limit > maxQueryLimit {
+		hq.Limit = maxQueryLimit
+	}
+	q := hq.query()
+	text := strings.ToLower(hq.Search)
+	found := make([]*StoredMessage, 0, hq.Limit)
+	scanned := 0
+	for {
+		records, next, err := s.DB.QueryRecords(ctx, s.Table, q)
+		if err != nil {
+			return nil, "", err
+		}
+		for i := range records {
+			stored, err := decode[*StoredMessage](s.Table, &records[i])
+			if err != nil {
+				return nil, "", err
+			}
+			if !stored.matches(text) {
+				continue
+			}
+			if found = append(found, stored); len(found) == hq.Limit {
+				if i == len(records)-1 {
+					return found, next, nil
+				}
+				cursor, err := q.cursor(&records[i])
+				return found, cursor, err
+			}
+		}
+		scanned += len(records)
+		if next == "" || scanned >= maxHistoryScan {
+			return found, next, nil
+		}
+		q.After = next
+	}
+}
+
+// parseHistoryTime reads a time given in milliseconds since the epoch or in
+// RFC 3339 form.
+func parseHistoryTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("%s Invalid time: %s", ErrBadQuery, value)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// DoHistory checks that user may read the history of hq.Room and runs hq.
+func (a *App) DoHistory(ctx context.Context, hq *HistoryQuery, user *User, scope *Scope) (*HistoryResponse, error) {
+	if a.Messages == nil || !a.Messages.Persists(hq.Room) {
+		return nil, ErrNotFound
+	}
+	if !scope.Allows(hq.Room, "history") || !a.CanAccess(a.Messages.DB.feed(a.Messages.Table), "read", user) {
+		return nil, ErrForbidden
+	}
+	messages, next, err := a.Messages.Search(ctx, hq)
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryResponse{Status: "ok", Room: hq.Room, Messages: messages, Next: next}, nil
+}
+
+func historyStatus(err error) int {
+	if strings.HasPrefix(err.Error(), ErrBadQuery.Error()) || err == ErrBadCursor {
+		return 400
+	}
+	return objectStatus(err)
+}
+
+func (a *App) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	user, scope, err := a.RequestUser(w, r)
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	hq := &HistoryQuery{
+		Room:   r.FormValue("room"),
+		Event:  r.FormValue("event"),
+		Search: r.FormValue("q"),
+		After:  r.FormValue("after"),
+	}
+	if hq.Since, err = parseHistoryTime(r.FormValue("since")); err == nil {
+		hq.Until, err = parseHistoryTime(r.FormValue("until"))
+	}
+	if err == nil && r.FormValue("limit") != "" {
+		if hq.Limit, err = strconv.Atoi(r.FormValue("limit")); err != nil {
+			err = fmt.Errorf("%s Invalid limit: %s", ErrBadQuery, r.FormValue("limit"))
+		}
+	}
+	if err != nil {
+		WriteError(w, 400, err.Error(), nil)
+		return
+	}
+	res, err := a.DoHistory(r.Context(), hq, user, scope)
+	if err != nil {
+		WriteError(w, historyStatus(err), err.Error(), nil)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (c *Conn) HandleHistory(msg *Message) error {
+	hq := &HistoryQuery{}
+	res := &HistoryResponse{Messages: make([]*StoredMessage, 0)}
+	err := json.Unmarshal(msg.Payload, hq)
+	if err == nil {
+		user := &User{Username: c.Username, Privilege: c.Privilege}
+		var done *HistoryResponse
+		if done, err = c.Application.DoHistory(c.Context(), hq, user, c.Scope); err == nil {
+			res = done
+		}
+	}
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		res.Room = hq.Room
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	response := &Message{
+		RoomLength:    len("root"),
+		Room:          "root",
+		EventLength:   len("history"),
+		Event:         "history",
+		DstLength:     len(c.Id),
+		Dst:           c.Id,
+		SrcLength:     len(c.Id),
+		Src:           c.Id,
+		PayloadLength: len(payload),
+		Payload:       payload,
+	}
+	c.deliver(MessageToBytes(response))
+	return nil
+}
@@ -0,0 +1,230 @@
+//    Title: history_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingStore fails the next Failures inserts and counts every insert.
+type failingStore struct {
+	Store
+	mu       sync.Mutex
+	Failures int
+	Inserts  int
+}
+
+func (s *failingStore) Insert(ctx context.Context, table string, key string, data []byte) error {
+	s.mu.Lock()
+	s.Inserts++
+	fail := s.Failures > 0
+	if fail {
+		s.Failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		return errors.New("Insert failed.")
+	}
+	return s.Store.Insert(ctx, table, key, data)
+}
+
+func (s *failingStore) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Inserts, s.Failures
+}
+
+// historyApp opens a memory database and a history store for the rooms
+// matching rooms, flushing only when asked to.
+func historyApp(t *testing.T, rooms string, batch string) (*App, *MessageStore) {
+	t.Helper()
+	a := NewApp()
+	db, err := a.NewDatabase("memory", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DB = db
+	store, err := a.NewMessageStore(map[string]string{"rooms": rooms, "batch_size": batch, "flush_interval": "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, store
+}
+
+func historyMessage(room string, event string, payload string) []byte {
+	return MessageToBytes(&Message{
+		RoomLength:    len(room),
+		Room:          room,
+		EventLength:   len(event),
+		Event:         event,
+		PayloadLength: len(payload),
+		Payload:       []byte(payload),
+	})
+}
+
+func TestHistoryPersists(t *testing.T) {
+	_, store := historyApp(t, "chat, games/*, *", "10")
+	tests := []struct {
+		room string
+		want bool
+	}{
+		{"chat", true},
+		{"games/chess", true},
+		{"lobby", true},
+		{feedPrefix + "history", false},
+		{feedPrefix + "users/jon", false},
+	}
+	for _, test := range tests {
+		if got := store.Persists(test.room); got != test.want {
+			t.Errorf("Persists(%q) = %v, want %v", test.room, got, test.want)
+		}
+	}
+	var none *MessageStore
+	if none.Persists("chat") {
+		t.Error("a nil store persists messages")
+	}
+}
+
+// TestHistoryPublishesNoChanges checks that storing history does not feed
+// back into itself through the change feed.
+func TestHistoryPublishesNoChanges(t *testing.T) {
+	a, store := historyApp(t, "*", "1")
+	changes := 0
+	a.Emitter.On("change", func(change *Change) { changes++ })
+	for i := 0; i < 3; i++ {
+		store.Record("chat", nil, historyMessage("chat", "say", `{"text":"hi"}`))
+	}
+	store.Flush()
+	records, err := a.DB.GetAllObjs(context.Background(), "history")
+	mustStore(t, err)
+	if len(records) != 3 {
+		t.Fatalf("stored %d messages, want 3", len(records))
+	}
+	if changes != 0 {
+		t.Fatalf("storing history published %d changes", changes)
+	}
+}
+
+func TestHistoryRetriesOnTheTicker(t *testing.T) {
+	a, store := historyApp(t, "chat", "1")
+	failing := &failingStore{Store: a.DB.Store, Failures: 1}
+	a.DB.Store = failing
+	store.Record("chat", nil, historyMessage("chat", "say", `"first"`))
+	deadline := time.Now().Add(time.Second)
+	for inserts, _ := failing.counts(); inserts == 0 && time.Now().Before(deadline); inserts, _ = failing.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		store.Record("chat", nil, historyMessage("chat", "say", `"more"`))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if inserts, _ := failing.counts(); inserts != 1 {
+		t.Fatalf("a failed batch was retried %d times before the ticker", inserts-1)
+	}
+	store.Flush()
+	records, err := a.DB.GetAllObjs(context.Background(), "history")
+	mustStore(t, err)
+	if len(records) != 6 {
+		t.Fatalf("stored %d messages after the retry, want 6", len(records))
+	}
+}
+
+func TestHistoryRecordNeverBlocks(t *testing.T) {
+	store := &MessageStore{queue: make(chan *StoredMessage, 2)}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			store.Record("chat", nil, historyMessage("chat", "say", `"hi"`))
+		}
+		store.Record("chat", nil, historyMessage("chat", "join", ""))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked on a full queue")
+	}
+	if dropped := store.Dropped(); dropped != 3 {
+		t.Fatalf("dropped %d messages, want 3", dropped)
+	}
+}
+
+func TestHistoryBackoff(t *testing.T) {
+	store := &MessageStore{FlushInterval: time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, maxHistoryBackoff},
+		{100, maxHistoryBackoff},
+	}
+	for _, test := range tests {
+		if got := store.backoff(test.failures); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+func TestHistorySearchIsBounded(t *testing.T) {
+	_, store := historyApp(t, "chat", "100")
+	total := maxHistoryScan + maxHistoryScan/2
+	for i := 0; i < total; i++ {
+		payload := `{"text":"hello"}`
+		if i == 0 {
+			payload = `{"text":"needle"}`
+		}
+		store.Record("chat", nil, historyMessage("chat", "say", payload))
+	}
+	store.Flush()
+	ctx := context.Background()
+	tests := []struct {
+		search string
+		limit  int
+		found  int
+		pages  int
+	}{
+		{"", 50, 50, 1},
+		{"hello", 10, 10, 1},
+		{"absent", 50, 0, 2},
+		{"needle", 50, 1, 2},
+	}
+	for _, test := range tests {
+		hq := &HistoryQuery{Room: "chat", Search: test.search, Limit: test.limit}
+		found, next, err := store.Search(ctx, hq)
+		mustStore(t, err)
+		pages := 1
+		for next != "" && len(found) < test.limit {
+			var more []*StoredMessage
+			hq.After = next
+			more, next, err = store.Search(ctx, hq)
+			mustStore(t, err)
+			found = append(found, more...)
+			pages++
+		}
+		if len(found) != test.found || pages != test.pages {
+			t.Errorf("%q: found %d messages in %d calls, want %d in %d", test.search, len(found), pages, test.found, test.pages)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+//    Title: index.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Index is a secondary index on a JSON field of the objects in Table.
+type Index struct {
+	Table  string
+	Field  string
+	Unique bool
+}
+
+// Indexer is implemented by drivers that can index JSON fields themselves.
+// Find returns the records whose field equals value.  Other drivers are
+// searched with a Query.
+type Indexer interface {
+	CreateIndex(ctx context.Context, index *Index) error
+	Find(ctx context.Context, index *Index, value interface{}) ([]Record, error)
+}
+
+// UniqueError reports a write refused by a unique index.  The SQL drivers
+// raise it without a Field, which Database fills in from the index named in
+// the driver's error.
+type UniqueError struct {
+	Table string
+	Field string
+	cause error
+}
+
+func (e *UniqueError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("An object in %s already has one of these unique values.", e.Table)
+	}
+	return fmt.Sprintf("An object in %s already has this %s.", e.Table, e.Field)
+}
+
+// uniqueError fills in the field of a UniqueError raised by the driver.
+func (db *Database) uniqueError(table string, err error) error {
+	unique, ok := err.(*UniqueError)
+	if !ok || unique.Field != "" || unique.cause == nil {
+		return err
+	}
+	for _, index := range db.indexes() {
+		if index.Table == table && index.Unique && strings.Contains(unique.cause.Error(), index.Name()) {
+			unique.Field = index.Field
+		}
+	}
+	return err
+}
+
+// Name is the name used for the index in the database.
+func (index *Index) Name() string {
+	return index.Table + "_" + strings.Replace(index.Field, ".", "_", -1) + "_idx"
+}
+
+// ParseIndexes reads a comma separated list of indexes of the form
+// "table.field" or "table.field unique".
+func ParseIndexes(list string) ([]*Index, error) {
+	indexes := make([]*Index, 0)
+	for _, item := range splitList(list) {
+		words := strings.Fields(item)
+		parts := strings.SplitN(words[0], ".", 2)
+		if len(parts) != 2 || !ValidTable(parts[0]) || !fieldPattern.MatchString(parts[1]) || parts[1] == "key" {
+			return nil, fmt.Errorf("Invalid index: %s", item)
+		}
+		index := &Index{Table: parts[0], Field: parts[1]}
+		for _, word := range words[1:] {
+			if word != "unique" {
+				return nil, fmt.Errorf("Invalid index: %s", item)
+			}
+			index.Unique = true
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// indexes returns the declared indexes.  CreateIndex may add to them while
+// writers are checking them, so both go through the tables lock.
+func (db *Database) indexes() []*Index {
+	if db.tables == nil {
+		return db.Indexes
+	}
+	db.tables.mu.RLock()
+	defer db.tables.mu.RUnlock()
+	return db.Indexes
+}
+
+func (db *Database) index(table string, field string) *Index {
+	for _, index := range db.indexes() {
+		if index.Table == table && index.Field == field {
+			return index
+		}
+	}
+	return nil
+}
+
+func (db *Database) CreateIndex(ctx context.Context, index *Index) error {
+	if err := db.checkTable(index.Table); err != nil {
+		return err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	if indexer, ok := db.Store.(Indexer); ok {
+		if err := indexer.CreateIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+	db.tables.mu.Lock()
+	defer db.tables.mu.Unlock()
+	for _, other := range db.Indexes {
+		if other.Table == index.Table && other.Field == index.Field {
+			return nil
+		}
+	}
+	db.Indexes = append(db.Indexes, index)
+	return nil
+}
+
+// FindRecords returns the records of table whose field equals value, using
+// an index if one was declared for the field.
+func (db *Database) FindRecords(ctx context.Context, table string, field string, value interface{}) ([]Record, error) {
+	if err := db.checkTable(table); err != nil {
+		return nil, err
+	}
+	q := &Query{Filters: []Filter{{Field: field, Op: "eq", Value: value}}}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if index := db.index(table, field); index != nil {
+		if indexer, ok := db.Store.(Indexer); ok {
+			ctx, cancel := db.context(ctx)
+			defer cancel()
+			return indexer.Find(ctx, index, q.Filters[0].Value)
+		}
+	}
+	records, _, err := db.QueryRecords(ctx, table, q)
+	return records, err
+}
+
+func (db *Database) FindObjs(ctx context.Context, table string, field string, value interface{}) ([]interface{}, error) {
+	records, err := db.FindRecords(ctx, table, field, value)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		var value interface{}
+		if err := json.Unmarshal(record.Data, &value); err != nil {
+			return nil, err
+		}
+		data = append(data, value)
+	}
+	return data, nil
+}
+
+// FindObj returns the first object of table whose field equals value, or
+// ErrNotFound.
+func (db *Database) FindObj(ctx context.Context, table string, field string, value interface{}) (interface{}, error) {
+	data, err := db.FindObjs(ctx, table, field, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return data[0], nil
+}
+
+// checkUnique fails with a UniqueError if another object in table has the
+// same value as blob in a uniquely indexed field.  Soft deleted objects keep
+// their values until they are reaped, so that restoring one never makes a
+// duplicate.  The SQL drivers also enforce unique indexes in the database;
+// for the others this check is all there is, so two racing writers can both
+// pass it.
+func (db *Database) checkUnique(ctx context.Context, table string, key string, blob []byte) error {
+	var data interface{}
+	for _, index := range db.indexes() {
+		if index.Table != table || !index.Unique {
+			continue
+		}
+		if data == nil {
+			if err := json.Unmarshal(blob, &data); err != nil {
+				return err
+			}
+		}
+		value, ok := fieldValue(key, data, index.Field)
+		if !ok || jsonType(value) == "" {
+			continue
+		}
+		records, err := db.FindRecords(ctx, table, index.Field, value)
+		if err != nil {
+			return err
+		}
+		tombstones, err := db.findTombstones(ctx, index, value)
+		if err != nil {
+			return err
+		}
+		for _, record := range append(records, tombstones...) {
+			if record.Key != key {
+				return &UniqueError{Table: table, Field: index.Field}
+			}
+		}
+	}
+	return nil
+}
+
+// findTombstones returns the soft deleted records of the index's table whose
+// field equals value, or none for drivers that do not implement Expirer.
+func (db *Database) findTombstones(ctx context.Context, index *Index, value interface{}) ([]Record, error) {
+	expirer, err := db.expirer()
+	if err != nil {
+		return nil, nil
+	}
+	return expirer.FindTombstones(ctx, index, value)
+}
@@ -0,0 +1,354 @@
+//    Title: limiter.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLocked = errors.New("Too many failed attempts.")
+
+type Attempt struct {
+	Failures int   `json:"failures"`
+	Last     int64 `json:"last"`
+	Locked   int64 `json:"locked"`
+}
+
+type AttemptStore interface {
+	Get(ctx context.Context, key string) (*Attempt, error)
+	Set(ctx context.Context, key string, attempt *Attempt) error
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryAttempts keeps attempts in memory.  Entries that have been neither
+// attempted nor locked for TTL are swept, so that guesses at random usernames
+// and addresses do not grow it without bound.
+type MemoryAttempts struct {
+	TTL      time.Duration
+	mu       sync.Mutex
+	attempts map[string]*Attempt
+	swept    time.Time
+}
+
+// DatabaseAttempts keeps attempts in a table so that lockouts survive
+// restarts and are shared by every node using the same database.  Updates are
+// not atomic across nodes, so counts under heavy concurrency are approximate.
+type DatabaseAttempts struct {
+	DB    *Database
+	Table string
+}
+
+type Limiter struct {
+	Application *App
+	Store       AttemptStore
+	MaxFailures int
+	IPFailures  int
+	LockTime    time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	mu          sync.Mutex
+}
+
+func NewMemoryAttempts(ttl time.Duration) *MemoryAttempts {
+	return &MemoryAttempts{TTL: ttl, attempts: make(map[string]*Attempt), swept: time.Now()}
+}
+
+func (m *MemoryAttempts) Get(ctx context.Context, key string) (*Attempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if attempt, ok := m.attempts[key]; ok {
+		copied := *attempt
+		return &copied, nil
+	}
+	return &Attempt{}, nil
+}
+
+func (m *MemoryAttempts) Set(ctx context.Context, key string, attempt *Attempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *attempt
+	m.attempts[key] = &copied
+	if now := time.Now(); m.TTL > 0 && now.Sub(m.swept) > m.TTL {
+		m.sweep(now)
+	}
+	return nil
+}
+
+func (m *MemoryAttempts) sweep(now time.Time) {
+	for key, attempt := range m.attempts {
+		if time.Unix(0, attempt.Last).Add(m.TTL).Before(now) && time.Unix(attempt.Locked, 0).Before(now) {
+			delete(m.attempts, key)
+		}
+	}
+	m.swept = now
+}
+
+func (m *MemoryAttempts) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func (d *DatabaseAttempts) Get(ctx context.Context, key string) (*Attempt, error) {
+	attempt, err := Get[*Attempt](ctx, d.DB, d.Table, key)
+	if err == ErrNotFound || (err == nil && attempt == nil) {
+		return &Attempt{}, nil
+	}
+	return attempt, err
+}
+
+func (d *DatabaseAttempts) Set(ctx context.Context, key string, attempt *Attempt) error {
+	return d.DB.UpsertObj(ctx, d.Table, key, attempt)
+}
+
+func (d *DatabaseAttempts) Delete(ctx context.Context, key string) error {
+	return d.DB.DeleteObj(ctx, d.Table, key)
+}
+
+func (a *App) NewLimiter(params map[string]string) (*Limiter, error) {
+	limiter := &Limiter{
+		Application: a,
+		MaxFailures: 5,
+		IPFailures:  50,
+		LockTime:    15 * time.Minute,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+	}
+	ints := map[string]*int{
+		"max_failures": &limiter.MaxFailures,
+		"ip_failures":  &limiter.IPFailures,
+	}
+	for key, dest := range ints {
+		if val, ok := params[key]; ok {
+			num, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid lockout value for %s: %s", key, val)
+			}
+			*dest = num
+		}
+	}
+	durations := map[string]*time.Duration{
+		"lock_time":  &limiter.LockTime,
+		"base_delay": &limiter.BaseDelay,
+		"max_delay":  &limiter.MaxDelay,
+	}
+	for key, dest := range durations {
+		if val, ok := params[key]; ok {
+			duration, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid lockout value for %s: %s", key, val)
+			}
+			*dest = duration
+		}
+	}
+	if params["store"] == "database" {
+		db, err := a.DBNamed(params["database"])
+		if err != nil {
+			return nil, fmt.Errorf("The database lockout store requires a database: %s", err)
+		}
+		table := params["table"]
+		if table == "" {
+			table = "attempts"
+		}
+		if err := db.CreateTable(context.Background(), table); err != nil {
+			return nil, err
+		}
+		limiter.Store = &DatabaseAttempts{DB: db, Table: table}
+	} else {
+		ttl := limiter.LockTime
+		if limiter.MaxDelay > ttl {
+			ttl = limiter.MaxDelay
+		}
+		limiter.Store = NewMemoryAttempts(ttl)
+	}
+	a.Limiter = limiter
+	return limiter, nil
+}
+
+func (l *Limiter) delay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := 1; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+// wait returns how long after now attempt holds off the next attempt.
+func (l *Limiter) wait(attempt *Attempt, now time.Time) time.Duration {
+	wait := time.Duration(0)
+	if locked := time.Unix(attempt.Locked, 0); locked.After(now) {
+		wait = locked.Sub(now)
+	}
+	next := time.Unix(0, attempt.Last).Add(l.delay(attempt.Failures))
+	if next.After(now) && next.Sub(now) > wait {
+		wait = next.Sub(now)
+	}
+	return wait
+}
+
+// reserve counts an attempt on each key of limits unless one of them must
+// still wait, returning the wait.  Attempts are counted before they are made,
+// under the limiter's lock, so that parallel attempts cannot all pass before
+// the first is counted.  With lock the limits lock their key at once,
+// otherwise only once Fail confirms the failure.
+func (l *Limiter) reserve(ctx context.Context, limits map[string]int, lock bool) (time.Duration, error) {
+	now := time.Now()
+	attempts := make(map[string]*Attempt)
+	wait := time.Duration(0)
+	for key := range limits {
+		attempt, err := l.Store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if keyWait := l.wait(attempt, now); keyWait > wait {
+			wait = keyWait
+		}
+		attempts[key] = attempt
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for key, limit := range limits {
+		attempt := attempts[key]
+		if attempt.Locked != 0 {
+			attempt.Failures = 0
+			attempt.Locked = 0
+		}
+		attempt.Failures++
+		attempt.Last = now.UnixNano()
+		if lock && limit > 0 && attempt.Failures >= limit {
+			attempt.Locked = now.Add(l.LockTime).Unix()
+		}
+		if err := l.Store.Set(ctx, key, attempt); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func (l *Limiter) loginLimits(username string, ip string) map[string]int {
+	return map[string]int{
+		"user:" + username: l.MaxFailures,
+		"ip:" + ip:         l.IPFailures,
+	}
+}
+
+// Attempt returns how long the caller must wait before an attempt for the
+// given username and address is allowed.  If the wait is 0 the attempt is
+// counted as a failure until Succeed takes it back, so every attempt must end
+// in Fail or Succeed.
+func (l *Limiter) Attempt(ctx context.Context, username string, ip string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reserve(ctx, l.loginLimits(username, ip), false)
+}
+
+// Throttle limits requests of the kind name, such as "reset", for key and
+// address.  Every request counts like a failed login: the delay before the
+// next one doubles, and after max_failures for key or ip_failures for the
+// address they are locked for lock_time.  It returns how long the caller must
+// wait, and counts the request only if that is 0.
+func (l *Limiter) Throttle(ctx context.Context, name string, key string, ip string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reserve(ctx, map[string]int{
+		name + ":user:" + key: l.MaxFailures,
+		name + ":ip:" + ip:    l.IPFailures,
+	}, true)
+}
+
+// Fail confirms that an attempt failed, locking the username or address once
+// it has reached its limit.
+func (l *Limiter) Fail(ctx context.Context, username string, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, limit := range l.loginLimits(username, ip) {
+		attempt, err := l.Store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if limit <= 0 || attempt.Failures < limit || attempt.Locked != 0 {
+			continue
+		}
+		attempt.Locked = now.Add(l.LockTime).Unix()
+		if strings.HasPrefix(key, "user:") {
+			l.Application.Emitter.Emit("accountlocked", username, ip, time.Unix(attempt.Locked, 0))
+		} else {
+			l.Application.Emitter.Emit("addresslocked", ip, time.Unix(attempt.Locked, 0))
+		}
+		if err := l.Store.Set(ctx, key, attempt); err != nil {
+			return err
+		}
+	}
+	l.Application.Emitter.Emit("loginfailed", username, ip)
+	return nil
+}
+
+// Succeed clears the failures of username and takes the attempt back from
+// the count of the address.
+func (l *Limiter) Succeed(ctx context.Context, username string, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.Store.Delete(ctx, "user:"+username); err != nil {
+		return err
+	}
+	attempt, err := l.Store.Get(ctx, "ip:"+ip)
+	if err != nil || attempt.Failures == 0 {
+		return err
+	}
+	attempt.Failures--
+	return l.Store.Set(ctx, "ip:"+ip, attempt)
+}
+
+// setRetryAfter tells a throttled client how long to wait and returns the
+// wait in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+func (a *App) RemoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if a.Proxy != "" && host == a.Proxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	return host
+}
@@ -0,0 +1,158 @@
+//    Title: limiter_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterDelay(t *testing.T) {
+	limiter := &Limiter{BaseDelay: time.Second, MaxDelay: time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if got := limiter.delay(test.failures); got != test.want {
+			t.Errorf("delay(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+// limiterApp returns a limiter without delays that locks a username after
+// three failures and an address after five, keeping its attempts in store.
+func limiterApp(t *testing.T, store string) *Limiter {
+	t.Helper()
+	a := NewApp()
+	db, err := a.NewDatabase("memory", map[string]string{})
+	mustStore(t, err)
+	a.DB = db
+	limiter, err := a.NewLimiter(map[string]string{"store": store, "max_failures": "3", "ip_failures": "5", "lock_time": "1h", "base_delay": "0s", "max_delay": "0s"})
+	mustStore(t, err)
+	return limiter
+}
+
+// login runs one login attempt and reports whether it was let through.
+func login(t *testing.T, limiter *Limiter, username string, ip string, ok bool) bool {
+	t.Helper()
+	ctx := context.Background()
+	wait, err := limiter.Attempt(ctx, username, ip)
+	mustStore(t, err)
+	if wait > 0 {
+		return false
+	}
+	if ok {
+		mustStore(t, limiter.Succeed(ctx, username, ip))
+	} else {
+		mustStore(t, limiter.Fail(ctx, username, ip))
+	}
+	return true
+}
+
+func TestLimiterLocksOut(t *testing.T) {
+	type attempt struct {
+		username string
+		ip       string
+		ok       bool
+		allowed  bool
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"username", []attempt{
+			{"jon", "a", false, true},
+			{"jon", "b", false, true},
+			{"jon", "c", false, true},
+			{"jon", "d", true, false},
+			{"ann", "a", true, true},
+		}},
+		{"success clears the username", []attempt{
+			{"jon", "a", false, true},
+			{"jon", "a", false, true},
+			{"jon", "a", true, true},
+			{"jon", "a", false, true},
+			{"jon", "a", false, true},
+			{"jon", "a", true, true},
+		}},
+		{"address", []attempt{
+			{"u1", "a", false, true},
+			{"u2", "a", false, true},
+			{"u3", "a", false, true},
+			{"u4", "a", false, true},
+			{"u5", "a", false, true},
+			{"u6", "a", true, false},
+			{"u6", "b", true, true},
+		}},
+	}
+	for _, store := range []string{"memory", "database"} {
+		for _, test := range tests {
+			t.Run(store+"/"+test.name, func(t *testing.T) {
+				limiter := limiterApp(t, store)
+				for i, attempt := range test.attempts {
+					if got := login(t, limiter, attempt.username, attempt.ip, attempt.ok); got != attempt.allowed {
+						t.Fatalf("attempt %d by %s from %s allowed %v, want %v", i+1, attempt.username, attempt.ip, got, attempt.allowed)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestLimiterCountsAttemptsFirst checks that an attempt holds off the next
+// one before it is known to have failed, so parallel guesses wait too.
+func TestLimiterCountsAttemptsFirst(t *testing.T) {
+	ctx := context.Background()
+	limiter := limiterApp(t, "memory")
+	limiter.BaseDelay = time.Minute
+	limiter.MaxDelay = time.Minute
+	if wait, err := limiter.Attempt(ctx, "jon", "a"); err != nil || wait != 0 {
+		t.Fatalf("first attempt waits %s: %v", wait, err)
+	}
+	if wait, err := limiter.Attempt(ctx, "jon", "b"); err != nil || wait == 0 {
+		t.Fatalf("a parallel attempt was let through: %v", err)
+	}
+	mustStore(t, limiter.Succeed(ctx, "jon", "a"))
+	if wait, err := limiter.Attempt(ctx, "jon", "b"); err != nil || wait != 0 {
+		t.Fatalf("attempt after a success waits %s: %v", wait, err)
+	}
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	ctx := context.Background()
+	limiter := limiterApp(t, "memory")
+	for i, want := range []bool{true, true, true, false} {
+		wait, err := limiter.Throttle(ctx, "reset", "jon", "a")
+		mustStore(t, err)
+		if (wait == 0) != want {
+			t.Fatalf("request %d allowed %v, want %v", i+1, wait == 0, want)
+		}
+	}
+	if wait, err := limiter.Attempt(ctx, "jon", "a"); err != nil || wait != 0 {
+		t.Fatalf("throttled resets locked the login: %s %v", wait, err)
+	}
+}
@@ -0,0 +1,97 @@
+//    Title: live.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+// liveView is the view a connection last requested from a live route.  A view
+// of a single object is refreshed when that object changes, and a list when
+// anything in its table changes.  One refresh of a view runs at a time:
+// rendering is set while it does, and pending when another change came in
+// that it may have missed.
+type liveView struct {
+	conn      *Conn
+	path      string
+	feed      string
+	key       string
+	rendering bool
+	pending   bool
+}
+
+// watchView records view as the live view of c, replacing the previous one.
+// A nil view stops watching.
+func (a *App) watchView(c *Conn, view *liveView) {
+	a.viewsMu.Lock()
+	defer a.viewsMu.Unlock()
+	if old, ok := a.viewing[c.Id]; ok {
+		delete(a.views[old.feed], c.Id)
+		if len(a.views[old.feed]) == 0 {
+			delete(a.views, old.feed)
+		}
+		delete(a.viewing, c.Id)
+	}
+	if view == nil {
+		return
+	}
+	if _, ok := a.views[view.feed]; !ok {
+		a.views[view.feed] = make(map[string]*liveView)
+	}
+	a.views[view.feed][c.Id] = view
+	a.viewing[c.Id] = view
+}
+
+// refreshViews renders the live views affected by change again.  A view that
+// is being rendered is only marked pending, so a burst of writes costs at
+// most one more render per view, and renders never overtake each other.
+func (a *App) refreshViews(change *Change) {
+	a.viewsMu.Lock()
+	defer a.viewsMu.Unlock()
+	for _, view := range a.views[change.Feed()] {
+		if view.key != "" && view.key != change.Key {
+			continue
+		}
+		if view.rendering {
+			view.pending = true
+			continue
+		}
+		view.rendering = true
+		go view.conn.refreshView(view)
+	}
+}
+
+// refreshView sends view again as an update, and again after that for as
+// long as changes came in while it rendered.  It stops once the connection
+// has moved on to another view or is gone.
+func (c *Conn) refreshView(view *liveView) {
+	a := c.Application
+	for {
+		data, _ := c.renderView(view.path)
+		a.viewsMu.Lock()
+		current := a.viewing[c.Id] == view && c.Context().Err() == nil
+		a.viewsMu.Unlock()
+		if data != nil && current {
+			data["update"] = "true"
+			c.sendResponse(data)
+		}
+		a.viewsMu.Lock()
+		if !current || !view.pending {
+			view.rendering = false
+			a.viewsMu.Unlock()
+			return
+		}
+		view.pending = false
+		a.viewsMu.Unlock()
+	}
+}
@@ -0,0 +1,143 @@
+//    Title: live_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// renderCounter tracks how many renders run at once.
+type renderCounter struct {
+	mu      sync.Mutex
+	active  int
+	most    int
+	renders int
+}
+
+func (r *renderCounter) slow() string {
+	r.mu.Lock()
+	r.active++
+	r.renders++
+	if r.active > r.most {
+		r.most = r.active
+	}
+	r.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+	r.mu.Lock()
+	r.active--
+	r.mu.Unlock()
+	return ""
+}
+
+func (r *renderCounter) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.most, r.renders
+}
+
+// liveApp serves the object a of the items table on the live route /item,
+// rendered as its n field.
+func liveApp(t *testing.T) (*App, *Conn, *renderCounter) {
+	t.Helper()
+	a := NewApp()
+	db, err := a.NewDatabase("memory", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DB = db
+	mustStore(t, db.CreateTable(context.Background(), "items"))
+	mustStore(t, db.InsertObj(context.Background(), "items", "a", map[string]int{"n": 0}))
+	counter := &renderCounter{}
+	a.Routes = map[string]map[string]string{
+		"^/item$": {"template": "item", "table": "items", "key": "a", "live": "true"},
+	}
+	a.Templates = template.Must(template.New("item").Funcs(template.FuncMap{"slow": counter.slow}).Parse(`{{slow}}{{range .}}{{.n}}{{end}}`))
+	c := &Conn{Application: a, Id: "viewer", Send: make(chan []byte, 1024)}
+	return a, c, counter
+}
+
+// lastRender waits for the view updates to stop and returns the last one.
+func lastRender(t *testing.T, c *Conn) string {
+	t.Helper()
+	last := ""
+	for {
+		select {
+		case data := <-c.Send:
+			response := make(map[string]string)
+			if err := json.Unmarshal(BytesToMessage(data).Payload, &response); err != nil {
+				t.Fatal(err)
+			}
+			last = response["template"]
+		case <-time.After(100 * time.Millisecond):
+			return last
+		}
+	}
+}
+
+func TestLiveViewShowsTheLastWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes int
+	}{
+		{"one", 1},
+		{"burst", 50},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, c, counter := liveApp(t)
+			c.SendView("/item")
+			if got := lastRender(t, c); got != "0" {
+				t.Fatalf("first render %q, want 0", got)
+			}
+			for i := 1; i <= test.writes; i++ {
+				mustStore(t, a.DB.UpdateObj(context.Background(), "items", "a", map[string]int{"n": i}))
+			}
+			if got, want := lastRender(t, c), strconv.Itoa(test.writes); got != want {
+				t.Fatalf("last render %q, want %s", got, want)
+			}
+			most, renders := counter.counts()
+			if most != 1 {
+				t.Fatalf("%d renders of the view ran at once", most)
+			}
+			if renders > test.writes+1 {
+				t.Fatalf("%d renders for %d writes", renders, test.writes)
+			}
+		})
+	}
+}
+
+func TestLiveViewStopsForClosedConnections(t *testing.T) {
+	a, c, counter := liveApp(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+	c.SendView("/item")
+	lastRender(t, c)
+	cancel()
+	mustStore(t, a.DB.UpdateObj(context.Background(), "items", "a", map[string]int{"n": 1}))
+	if got := lastRender(t, c); got != "" {
+		t.Fatalf("a closed connection was sent %q", got)
+	}
+	if _, renders := counter.counts(); renders > 2 {
+		t.Fatalf("%d renders for a closed connection", renders)
+	}
+}
@@ -0,0 +1,92 @@
+//    Title: mail.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+type LogMailer struct {
+	File string
+	mu   sync.Mutex
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", m.From, to, subject, strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	msg := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	if m.File == "" {
+		log.Print(msg)
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(msg)
+	return err
+}
+
+func (a *App) NewMailer(name string, params map[string]string) Mailer {
+	var mailer Mailer
+	switch name {
+	case "smtp":
+		port := params["port"]
+		if port == "" {
+			port = "25"
+		}
+		mailer = &SMTPMailer{
+			Host:     params["host"],
+			Port:     port,
+			Username: params["username"],
+			Password: params["password"],
+			From:     params["from"],
+		}
+	default:
+		mailer = &LogMailer{File: params["file"]}
+	}
+	a.Mailer = mailer
+	return mailer
+}
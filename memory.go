@@ -0,0 +1,344 @@
+//    Title: memory.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps every table in process memory.  It does not implement
+// Transactor; Database.Tx reports ErrNoTx.  Expired and soft deleted records
+// stay in memory until they are reaped.
+type MemoryStore struct {
+	Tables map[string]map[string]*Record
+	mu     sync.RWMutex
+}
+
+func init() {
+	RegisterDriver("memory", func() Store {
+		return NewMemoryStore()
+	})
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Tables: make(map[string]map[string]*Record)}
+}
+
+func copyRecord(record *Record) *Record {
+	return &Record{
+		Key:     record.Key,
+		Data:    append([]byte(nil), record.Data...),
+		Version: record.Version,
+		Expires: record.Expires,
+		Deleted: record.Deleted,
+	}
+}
+
+// lookup returns the live record of key, or nil.  It must be called with s.mu
+// held.
+func (s *MemoryStore) lookup(table string, key string) (map[string]*Record, *Record, error) {
+	rows, exists := s.Tables[table]
+	if !exists {
+		return nil, nil, ErrNoTable
+	}
+	if record := rows[key]; record.alive(unixMillis(time.Now())) {
+		return rows, record, nil
+	}
+	return rows, nil, nil
+}
+
+// next returns the record a write to key would store, without its data, or
+// an error if the write is not allowed.  Writes set the expiry to expires,
+// or keep the one of the record they replace for 0.  It must be called with
+// s.mu held.
+func (s *MemoryStore) next(op string, table string, key string, version int64, expires int64) (*Record, error) {
+	_, record, err := s.lookup(table, key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case op == "insert" && record != nil:
+		return nil, ErrExists
+	case op == "insert" || op == "upsert" && record == nil:
+		return &Record{Key: key, Version: 1, Expires: expires}, nil
+	case record == nil:
+		return nil, ErrNotFound
+	case version != 0 && record.Version != version:
+		return nil, ErrConflict
+	}
+	if expires == 0 {
+		expires = record.Expires
+	}
+	return &Record{Key: key, Version: record.Version + 1, Expires: expires}, nil
+}
+
+// mark returns a copy of the record of key as op would leave it: expire sets
+// its expiry, softdelete marks it deleted and restore unmarks it.  It must be
+// called with s.mu held.
+func (s *MemoryStore) mark(op string, table string, key string, version int64, expires int64) (*Record, error) {
+	rows, exists := s.Tables[table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	record := rows[key]
+	now := unixMillis(time.Now())
+	if op == "restore" {
+		if record == nil || record.Deleted == 0 || record.Expires != 0 && record.Expires <= now {
+			return nil, ErrNotFound
+		}
+	} else if !record.alive(now) {
+		return nil, ErrNotFound
+	} else if version != 0 && record.Version != version {
+		return nil, ErrConflict
+	}
+	marked := copyRecord(record)
+	switch op {
+	case "expire":
+		marked.Expires = expires
+	case "softdelete":
+		marked.Deleted = now
+		marked.Version++
+	case "restore":
+		marked.Deleted = 0
+		marked.Version++
+	}
+	return marked, nil
+}
+
+// reapable returns the keys of the records of table that Reap removes.  It
+// must be called with s.mu held.
+func (s *MemoryStore) reapable(table string, before int64) ([]string, error) {
+	rows, exists := s.Tables[table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	now := unixMillis(time.Now())
+	keys := make([]string, 0)
+	for key, record := range rows {
+		if record.Expires != 0 && record.Expires <= now || record.Deleted != 0 && record.Deleted < before {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Open(ctx context.Context, params map[string]string) error {
+	return nil
+}
+
+func (s *MemoryStore) CreateTable(ctx context.Context, table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.Tables[table]; !exists {
+		s.Tables[table] = make(map[string]*Record)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, table string, key string) (*Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, record, err := s.lookup(table, key)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrNotFound
+	}
+	return copyRecord(record), nil
+}
+
+func (s *MemoryStore) All(ctx context.Context, table string) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, exists := s.Tables[table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	now := unixMillis(time.Now())
+	records := make([]Record, 0, len(rows))
+	for _, record := range rows {
+		if record.alive(now) {
+			records = append(records, *copyRecord(record))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	return records, nil
+}
+
+func (s *MemoryStore) write(ctx context.Context, op string, table string, key string, data []byte, version int64, expires int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.next(op, table, key, version, expires)
+	if err != nil {
+		return 0, err
+	}
+	record.Data = append([]byte(nil), data...)
+	s.Tables[table][key] = record
+	return record.Version, nil
+}
+
+func (s *MemoryStore) Insert(ctx context.Context, table string, key string, data []byte) error {
+	_, err := s.write(ctx, "insert", table, key, data, 0, 0)
+	return err
+}
+
+func (s *MemoryStore) Update(ctx context.Context, table string, key string, data []byte, version int64) (int64, error) {
+	return s.write(ctx, "update", table, key, data, version, 0)
+}
+
+func (s *MemoryStore) Upsert(ctx context.Context, table string, key string, data []byte) (int64, error) {
+	return s.write(ctx, "upsert", table, key, data, 0, 0)
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, table string, key string, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, record, err := s.lookup(table, key)
+	if err != nil {
+		return err
+	}
+	if version != 0 {
+		if record == nil {
+			return ErrNotFound
+		}
+		if record.Version != version {
+			return ErrConflict
+		}
+	}
+	delete(rows, key)
+	return nil
+}
+
+func (s *MemoryStore) update(ctx context.Context, op string, table string, key string, version int64, expires int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.mark(op, table, key, version, expires)
+	if err != nil {
+		return 0, err
+	}
+	s.Tables[table][key] = record
+	return record.Version, nil
+}
+
+func (s *MemoryStore) WriteExpiring(ctx context.Context, op string, table string, key string, data []byte, version int64, expires int64) (int64, error) {
+	return s.write(ctx, op, table, key, data, version, expires)
+}
+
+func (s *MemoryStore) Expire(ctx context.Context, table string, key string, expires int64) error {
+	_, err := s.update(ctx, "expire", table, key, 0, expires)
+	return err
+}
+
+func (s *MemoryStore) SoftDelete(ctx context.Context, table string, key string, version int64) error {
+	_, err := s.update(ctx, "softdelete", table, key, version, 0)
+	return err
+}
+
+func (s *MemoryStore) Restore(ctx context.Context, table string, key string) (int64, error) {
+	return s.update(ctx, "restore", table, key, 0, 0)
+}
+
+func (s *MemoryStore) Tombstones(ctx context.Context, table string) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, exists := s.Tables[table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	records := make([]Record, 0)
+	for _, record := range rows {
+		if record.Deleted != 0 {
+			records = append(records, *copyRecord(record))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	return records, nil
+}
+
+func (s *MemoryStore) FindTombstones(ctx context.Context, index *Index, value interface{}) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, exists := s.Tables[index.Table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	want := jsonArg(value)
+	records := make([]Record, 0)
+	for key, record := range rows {
+		var data interface{}
+		if record.Deleted == 0 || json.Unmarshal(record.Data, &data) != nil {
+			continue
+		}
+		if other, ok := fieldValue(key, data, index.Field); ok && jsonArg(other) == want {
+			records = append(records, *copyRecord(record))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	return records, nil
+}
+
+func (s *MemoryStore) Reap(ctx context.Context, table string, before int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := s.reapable(table, before)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		delete(s.Tables[table], key)
+	}
+	return len(keys), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
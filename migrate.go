@@ -0,0 +1,382 @@
+//    Title: migrate.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const migrationsTable = "schema_migrations"
+
+var (
+	ErrNoDatabase  = errors.New("No database configured.")
+	migrationFile  = regexp.MustCompile(`^([0-9]+)_([A-Za-z0-9_\-]+)\.(up|down)\.sql$`)
+	migrationStmt  = regexp.MustCompile(`;[ \t]*(\r?\n|$)`)
+	migrationsMu   sync.Mutex
+	migrationsList = make(map[int64]*Migration)
+)
+
+// Migration moves the database from one schema version to the next.  Up and
+// Down are written in Go and work with every driver; UpSQL and DownSQL are
+// run by the SQL drivers only.  A migration without Down or DownSQL cannot
+// be reverted.  Registered migrations run against every configured database
+// unless Database names the one they belong to.
+type Migration struct {
+	Version  int64
+	Name     string
+	Database string
+	Up       func(ctx context.Context, db *Database) error
+	Down     func(ctx context.Context, db *Database) error
+	UpSQL    string
+	DownSQL  string
+}
+
+type appliedMigration struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"`
+	Applied int64  `json:"applied"`
+}
+
+func RegisterMigration(migration *Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if migration == nil || migration.Version <= 0 {
+		panic("rtgo: RegisterMigration needs a positive version")
+	}
+	if _, dup := migrationsList[migration.Version]; dup {
+		panic(fmt.Sprintf("rtgo: RegisterMigration called twice for version %d", migration.Version))
+	}
+	migrationsList[migration.Version] = migration
+}
+
+// LoadMigrations reads SQL migrations from dir.  Files are named after the
+// version, a name and the direction, as in 0002_add_posts.up.sql and
+// 0002_add_posts.down.sql.
+func LoadMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int64]*Migration)
+	for _, file := range files {
+		match := migrationFile.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("Invalid migration file: %s", file.Name())
+		}
+		migration, ok := found[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			found[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d has two names: %s and %s", version, migration.Name, match[2])
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			migration.UpSQL = string(contents)
+		} else {
+			migration.DownSQL = string(contents)
+		}
+	}
+	migrations := make([]*Migration, 0, len(found))
+	for _, migration := range found {
+		if strings.TrimSpace(migration.UpSQL) == "" {
+			return nil, fmt.Errorf("Migration %d has no up file.", migration.Version)
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+// Migrations returns the registered migrations together with those in the
+// directory named by the database's "migrations" setting, ordered by
+// version.
+func (db *Database) Migrations() ([]*Migration, error) {
+	migrationsMu.Lock()
+	migrations := make([]*Migration, 0, len(migrationsList))
+	for _, migration := range migrationsList {
+		if migration.Database == "" || migration.Database == db.Name {
+			migrations = append(migrations, migration)
+		}
+	}
+	migrationsMu.Unlock()
+	if dir := db.Params["migrations"]; dir != "" {
+		loaded, err := LoadMigrations(dir)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, loaded...)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("Migration %d is defined twice.", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+func migrationKey(version int64) string {
+	return fmt.Sprintf("%020d", version)
+}
+
+// MigrationVersions returns the versions of the applied migrations in
+// ascending order.
+func (db *Database) MigrationVersions(ctx context.Context) ([]int64, error) {
+	if err := db.CreateTable(ctx, migrationsTable); err != nil {
+		return nil, err
+	}
+	applied, _, err := List[*appliedMigration](ctx, db, migrationsTable, nil)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int64, 0, len(applied))
+	for _, migration := range applied {
+		versions = append(versions, migration.Version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+	return versions, nil
+}
+
+// MigrateUp applies the pending migrations up to and including version to,
+// or all of them if to is 0.  With dryRun it only writes the plan to out.
+func (db *Database) MigrateUp(ctx context.Context, to int64, dryRun bool, out io.Writer) error {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	versions, err := db.MigrationVersions(ctx)
+	if err != nil {
+		return err
+	}
+	applied := make(map[int64]bool, len(versions))
+	for _, version := range versions {
+		applied[version] = true
+	}
+	pending := make([]*Migration, 0)
+	for _, migration := range migrations {
+		if !applied[migration.Version] && (to == 0 || migration.Version <= to) {
+			pending = append(pending, migration)
+		}
+	}
+	return db.runMigrations(ctx, "up", pending, dryRun, out)
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first.
+func (db *Database) MigrateDown(ctx context.Context, steps int, dryRun bool, out io.Writer) error {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	versions, err := db.MigrationVersions(ctx)
+	if err != nil {
+		return err
+	}
+	known := make(map[int64]*Migration, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = migration
+	}
+	reverting := make([]*Migration, 0)
+	for i := len(versions) - 1; i >= 0 && len(reverting) < steps; i-- {
+		migration, ok := known[versions[i]]
+		if !ok {
+			return fmt.Errorf("Applied migration %d is not defined.", versions[i])
+		}
+		if migration.Down == nil && strings.TrimSpace(migration.DownSQL) == "" {
+			return fmt.Errorf("Migration %d cannot be reverted.", migration.Version)
+		}
+		reverting = append(reverting, migration)
+	}
+	return db.runMigrations(ctx, "down", reverting, dryRun, out)
+}
+
+func (db *Database) runMigrations(ctx context.Context, direction string, migrations []*Migration, dryRun bool, out io.Writer) error {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	if len(migrations) == 0 {
+		fmt.Fprintf(out, "%s: nothing to migrate\n", db.Name)
+		return nil
+	}
+	for _, migration := range migrations {
+		fn, statements := migration.Up, splitStatements(migration.UpSQL)
+		if direction == "down" {
+			fn, statements = migration.Down, splitStatements(migration.DownSQL)
+		}
+		fmt.Fprintf(out, "%s: %s %d %s\n", db.Name, direction, migration.Version, migration.Name)
+		if dryRun {
+			if fn != nil {
+				fmt.Fprintln(out, "    (go function)")
+			}
+			for _, statement := range statements {
+				fmt.Fprintf(out, "    %s;\n", strings.Replace(statement, "\n", "\n    ", -1))
+			}
+			continue
+		}
+		if err := db.runMigration(ctx, direction, migration, fn, statements); err != nil {
+			return fmt.Errorf("Migration %d %s failed: %s", migration.Version, direction, err)
+		}
+	}
+	return nil
+}
+
+// runMigration applies one migration and records it in schema_migrations,
+// inside a transaction if the driver has them.  MySQL commits the
+// transaction at every schema change, which would commit the record with
+// the first one, so there the migration runs first and is recorded only
+// once it succeeds, as without transactions; a migration failing halfway is
+// not undone.  Migrations are not bounded by the database's default timeout.
+func (db *Database) runMigration(ctx context.Context, direction string, migration *Migration, fn func(ctx context.Context, db *Database) error, statements []string) error {
+	mdb := db.In(db.Store)
+	mdb.Timeout = 0
+	run := func(mdb *Database) error {
+		if len(statements) > 0 {
+			sqlstore, ok := mdb.Store.(*SQLStore)
+			if !ok {
+				return errors.New("SQL migrations need a SQL driver.")
+			}
+			for _, statement := range statements {
+				if _, err := sqlstore.Exec(ctx, statement); err != nil {
+					return err
+				}
+			}
+		}
+		if fn != nil {
+			return fn(ctx, mdb)
+		}
+		return nil
+	}
+	record := func(mdb *Database) error {
+		if direction == "down" {
+			return mdb.DeleteObj(ctx, migrationsTable, migrationKey(migration.Version))
+		}
+		return mdb.InsertObj(ctx, migrationsTable, migrationKey(migration.Version), &appliedMigration{
+			Version: migration.Version,
+			Name:    migration.Name,
+			Applied: time.Now().Unix(),
+		})
+	}
+	_, transactional := db.Store.(Transactor)
+	if sqlstore, ok := db.Store.(*SQLStore); ok && sqlstore.Dialect.DDLCommits {
+		transactional = false
+	}
+	if !transactional {
+		if err := run(mdb); err != nil {
+			return err
+		}
+		return record(mdb)
+	}
+	// The record is written first so that a second node migrating at the
+	// same time waits on it and then fails, rather than running the
+	// migration twice.
+	return mdb.Tx(ctx, func(tx Store) error {
+		if err := record(mdb.In(tx)); err != nil {
+			return err
+		}
+		return run(mdb.In(tx))
+	})
+}
+
+// splitStatements splits a SQL migration into statements at each semicolon
+// that ends a line.
+func splitStatements(script string) []string {
+	statements := make([]string, 0)
+	for _, statement := range migrationStmt.Split(script, -1) {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// MigrateCommand runs the migrate command line against the default database,
+// or the one named by -db: "up" or "down", followed by -to (up to this
+// version), -steps (how many migrations to revert, default 1) and -dry-run.
+func (a *App) MigrateCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := flags.Int64("to", 0, "Migrate up to this version.")
+	steps := flags.Int("steps", 1, "How many migrations to revert.")
+	dryRun := flags.Bool("dry-run", false, "Print the migrations instead of running them.")
+	dbname := flags.String("db", "", "The database to migrate (default is the default database).")
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down") {
+		return errors.New("Usage: migrate up|down [-db name] [-to version] [-steps n] [-dry-run]")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	db, err := a.commandDatabase(*dbname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if args[0] == "down" {
+		return db.MigrateDown(context.Background(), *steps, *dryRun, out)
+	}
+	return db.MigrateUp(context.Background(), *to, *dryRun, out)
+}
+
+// commandDatabase opens the configured database name, or the default one if
+// name is empty, for a command run outside the app.  Pending migrations are
+// not applied.
+func (a *App) commandDatabase(name string) (*Database, error) {
+	if name == "" {
+		var err error
+		if name, err = a.DefaultDatabase(); err != nil {
+			return nil, err
+		}
+	}
+	params, ok := a.Database[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown database: %s", name)
+	}
+	store, err := NewStore(databaseDriver(name, params))
+	if err != nil {
+		return nil, err
+	}
+	copied := make(map[string]string, len(params))
+	for key, val := range params {
+		copied[key] = val
+	}
+	delete(copied, "migrate")
+	db := &Database{Application: a, Name: name, Driver: databaseDriver(name, params), Params: copied, Store: store}
+	if err := db.Start(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,123 @@
+//    Title: migrate_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// migrationApp opens a sqlite database migrating from the SQL files given
+// by name.
+func migrationApp(t *testing.T, files map[string]string) *Database {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range files {
+		mustStore(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0600))
+	}
+	db, err := NewApp().NewDatabase("sqlite3", map[string]string{"file": filepath.Join(dir, "rtgo.sqlite"), "migrations": dir})
+	mustStore(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *Database, table string) bool {
+	t.Helper()
+	var count int
+	store := db.Store.(*SQLStore)
+	mustStore(t, store.conn().QueryRowContext(context.Background(), "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count))
+	return count > 0
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := migrationApp(t, map[string]string{
+		"0001_posts.up.sql":   "CREATE TABLE posts (id INTEGER);\nCREATE TABLE drafts (id INTEGER);",
+		"0001_posts.down.sql": "DROP TABLE drafts;\nDROP TABLE posts;",
+		"0002_tags.up.sql":    "CREATE TABLE tags (id INTEGER);\nINSERT INTO nowhere VALUES (1);",
+	})
+	steps := []struct {
+		name     string
+		run      func() error
+		fails    bool
+		versions []int64
+		tables   map[string]bool
+	}{
+		{"dry run", func() error {
+			var out bytes.Buffer
+			err := db.MigrateUp(ctx, 0, true, &out)
+			if !strings.Contains(out.String(), "CREATE TABLE posts (id INTEGER);") {
+				t.Errorf("the dry run printed %q", out.String())
+			}
+			return err
+		}, false, []int64{}, map[string]bool{"posts": false}},
+		{"up to 1", func() error { return db.MigrateUp(ctx, 1, false, nil) }, false, []int64{1}, map[string]bool{"posts": true, "drafts": true}},
+		{"failing up", func() error { return db.MigrateUp(ctx, 0, false, nil) }, true, []int64{1}, map[string]bool{"tags": false}},
+		{"down", func() error { return db.MigrateDown(ctx, 1, false, nil) }, false, []int64{}, map[string]bool{"posts": false, "drafts": false}},
+	}
+	for _, step := range steps {
+		if err := step.run(); (err != nil) != step.fails {
+			t.Fatalf("%s: got %v, want failure %v", step.name, err, step.fails)
+		}
+		versions, err := db.MigrationVersions(ctx)
+		mustStore(t, err)
+		if len(versions) != len(step.versions) || (len(versions) > 0 && !reflect.DeepEqual(versions, step.versions)) {
+			t.Fatalf("%s: applied %v, want %v", step.name, versions, step.versions)
+		}
+		for table, want := range step.tables {
+			if got := tableExists(t, db, table); got != want {
+				t.Fatalf("%s: table %s exists %v, want %v", step.name, table, got, want)
+			}
+		}
+	}
+}
+
+// TestCreateTableAddsColumns checks that tables made before the version,
+// expires and deleted columns get them, also inside a transaction.
+func TestCreateTableAddsColumns(t *testing.T) {
+	ctx := context.Background()
+	db := migrationApp(t, nil)
+	store := db.Store.(*SQLStore)
+	for _, table := range []string{"plain", "intx"} {
+		_, err := store.Exec(ctx, "CREATE TABLE "+table+" (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BLOB)")
+		mustStore(t, err)
+	}
+	mustStore(t, db.CreateTable(ctx, "plain"))
+	mustStore(t, db.Tx(ctx, func(tx Store) error {
+		if err := tx.CreateTable(ctx, "intx"); err != nil {
+			return err
+		}
+		return tx.Insert(ctx, "intx", "a", []byte(`{"n":1}`))
+	}))
+	for _, table := range []string{"plain", "intx"} {
+		for _, column := range sqlColumns {
+			exists, err := store.columnExists(ctx, table, column[0])
+			mustStore(t, err)
+			if !exists {
+				t.Errorf("%s has no %s column", table, column[0])
+			}
+		}
+	}
+	record, err := store.Get(ctx, "intx", "a")
+	mustStore(t, err)
+	expectRecord(t, record, "a", `{"n":1}`, 1)
+}
@@ -0,0 +1,291 @@
+//    Title: objects.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrForbidden = errors.New("Access denied.")
+
+type ObjectRequest struct {
+	DB      string          `json:"db,omitempty"`
+	Table   string          `json:"table"`
+	Key     string          `json:"key"`
+	Version int64           `json:"version,omitempty"`
+	Create  bool            `json:"create,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type ObjectResponse struct {
+	Action  string      `json:"action,omitempty"`
+	Status  string      `json:"status,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	DB      string      `json:"db,omitempty"`
+	Table   string      `json:"table,omitempty"`
+	Key     string      `json:"key"`
+	Version int64       `json:"version,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func guestUser() *User {
+	return &User{Username: "guest", Privilege: "user"}
+}
+
+// RequestUser identifies the sender of an HTTP request by bearer token or API
+// key first and by session cookie second.  Anyone else is a guest.
+func (a *App) RequestUser(w http.ResponseWriter, r *http.Request) (*User, *Scope, error) {
+	if requestToken(r) != "" {
+		return a.TokenUser(r)
+	}
+	if user, err := a.SessionUser(w, r); err == nil {
+		return user, nil, nil
+	}
+	return guestUser(), nil, nil
+}
+
+// CanAccess checks the access rule configured for the table and operation,
+// which is "read" or "write".  A rule is a comma separated list of "all",
+// "user" for anyone logged in, or privilege names.  Tables without a rule are
+// not accessible.  Tables are named as TableNamed reads them.
+func (a *App) CanAccess(table string, op string, user *User) bool {
+	rule := a.Access[table][op]
+	for _, allowed := range splitList(rule) {
+		switch allowed {
+		case "all":
+			return true
+		case "user":
+			if user.Username != "" && user.Username != "guest" {
+				return true
+			}
+		default:
+			if user.Privilege == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func objectOp(action string) string {
+	if action == "getobj" {
+		return "read"
+	}
+	return "write"
+}
+
+// DoObject runs one object operation on behalf of user.  The version is the
+// one the client expects the object to have; 0 makes the write unconditional.
+func (a *App) DoObject(ctx context.Context, action string, req *ObjectRequest, user *User) (*ObjectResponse, error) {
+	var (
+		data    interface{}
+		version int64
+		err     error
+	)
+	if req.Table == "" || req.Key == "" {
+		return nil, ErrNotFound
+	}
+	rule := req.Table
+	if req.DB != "" {
+		rule = req.DB + "." + req.Table
+	}
+	if !a.CanAccess(rule, objectOp(action), user) {
+		return nil, ErrForbidden
+	}
+	db, err := a.DBNamed(req.DB)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if len(req.Data) > 0 {
+		if err := json.Unmarshal(req.Data, &data); err != nil {
+			return nil, err
+		}
+	}
+	switch action {
+	case "getobj":
+		data, version, err = db.GetObjVersion(ctx, req.Table, req.Key)
+	case "putobj":
+		switch {
+		case req.Create:
+			version, err = 1, db.InsertObj(ctx, req.Table, req.Key, data)
+		case req.Version != 0:
+			version, err = db.UpdateObjVersion(ctx, req.Table, req.Key, data, req.Version)
+		default:
+			if err = db.UpsertObj(ctx, req.Table, req.Key, data); err == nil {
+				_, version, err = db.GetObjVersion(ctx, req.Table, req.Key)
+			}
+		}
+	case "patchobj":
+		data, version, err = db.PatchObjVersion(ctx, req.Table, req.Key, data, req.Version)
+	case "deleteobj":
+		data, err = nil, db.DeleteObjVersion(ctx, req.Table, req.Key, req.Version)
+	default:
+		return nil, errors.New("Unknown object action.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectResponse{
+		Action:  action,
+		Status:  "ok",
+		DB:      req.DB,
+		Table:   req.Table,
+		Key:     req.Key,
+		Version: version,
+		Data:    data,
+	}, nil
+}
+
+func objectStatus(err error) int {
+	switch err {
+	case ErrNotFound, ErrNoTable:
+		return 404
+	case ErrForbidden:
+		return 403
+	case ErrConflict, ErrExists:
+		return 412
+	case ErrNoDatabase:
+		return 503
+	}
+	if _, ok := err.(*json.SyntaxError); ok {
+		return 400
+	}
+	if _, ok := err.(*UniqueError); ok {
+		return 409
+	}
+	if _, ok := err.(*TableError); ok {
+		return 404
+	}
+	return 500
+}
+
+func etag(version int64) string {
+	return "\"" + strconv.FormatInt(version, 10) + "\""
+}
+
+func parseETag(header string) int64 {
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(strings.TrimSpace(header), "W/"), "\""), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return version
+}
+
+// ObjectHandler serves /objects/<table>/<key>.  GET returns the object with
+// its version as the ETag.  PUT, PATCH and DELETE honour If-Match, and PUT
+// with If-None-Match: * only creates.
+func (a *App) ObjectHandler(w http.ResponseWriter, r *http.Request) {
+	var action string
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/objects/"), "/", 2)
+	if len(parts) != 2 {
+		WriteError(w, 404, ErrNotFound.Error(), nil)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		action = "getobj"
+	case "PUT":
+		action = "putobj"
+	case "PATCH":
+		action = "patchobj"
+	case "DELETE":
+		action = "deleteobj"
+	default:
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	user, scope, err := a.RequestUser(w, r)
+	if err != nil {
+		WriteError(w, 401, err.Error(), nil)
+		return
+	}
+	if !scope.Allows("root", action) {
+		WriteError(w, 403, ErrForbidden.Error(), nil)
+		return
+	}
+	req := &ObjectRequest{DB: r.URL.Query().Get("db"), Table: parts[0], Key: parts[1]}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" {
+		if req.Version = parseETag(match); req.Version <= 0 {
+			WriteError(w, 412, ErrConflict.Error(), nil)
+			return
+		}
+	}
+	req.Create = r.Header.Get("If-None-Match") == "*" && action == "putobj"
+	if action == "putobj" || action == "patchobj" {
+		if req.Data, err = ioutil.ReadAll(r.Body); err != nil {
+			WriteError(w, 400, err.Error(), nil)
+			return
+		}
+	}
+	res, err := a.DoObject(r.Context(), action, req, user)
+	if err != nil {
+		WriteError(w, objectStatus(err), err.Error(), nil)
+		return
+	}
+	if action == "getobj" && r.Header.Get("If-None-Match") == etag(res.Version) {
+		w.WriteHeader(304)
+		return
+	}
+	if action != "deleteobj" {
+		w.Header().Set("ETag", etag(res.Version))
+	}
+	writeJSON(w, res)
+}
+
+func (c *Conn) HandleObject(msg *Message) error {
+	req := &ObjectRequest{}
+	res := &ObjectResponse{Action: msg.Event}
+	err := json.Unmarshal(msg.Payload, req)
+	if err == nil {
+		user := &User{Username: c.Username, Privilege: c.Privilege}
+		var done *ObjectResponse
+		if done, err = c.Application.DoObject(c.Context(), msg.Event, req, user); err == nil {
+			res = done
+		}
+	}
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		res.DB = req.DB
+		res.Table = req.Table
+		res.Key = req.Key
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	response := &Message{
+		RoomLength:    len("root"),
+		Room:          "root",
+		EventLength:   len("object"),
+		Event:         "object",
+		DstLength:     len(c.Id),
+		Dst:           c.Id,
+		SrcLength:     len(c.Id),
+		Src:           c.Id,
+		PayloadLength: len(payload),
+		Payload:       payload,
+	}
+	c.deliver(MessageToBytes(response))
+	return nil
+}
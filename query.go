@@ -0,0 +1,384 @@
+//    Title: query.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxQueryLimit = 1000
+
+var (
+	ErrBadQuery  = errors.New("Invalid query.")
+	ErrBadCursor = errors.New("Invalid cursor.")
+	fieldPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+	queryOps     = map[string]bool{"eq": true, "ne": true, "lt": true, "lte": true, "gt": true, "gte": true}
+)
+
+// Filter compares a field of each object with Value.  Field is a dot
+// separated path into the object, or "key" for the object's key.  A filter
+// only matches objects whose field holds the same JSON type as Value.
+type Filter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// Query selects objects from a table.  Results are ordered by Sort and then
+// by key.  After is the cursor returned with the previous page.
+type Query struct {
+	Filters []Filter
+	Sort    []Sort
+	Limit   int
+	Offset  int
+	After   string
+}
+
+// Querier is implemented by drivers that can run a Query themselves.  Query
+// returns at most q.Limit records, or all of them if it is 0.  Drivers that do
+// not implement it are queried in memory.
+type Querier interface {
+	Query(ctx context.Context, table string, q *Query) ([]Record, error)
+}
+
+type cursor struct {
+	Values []interface{} `json:"v"`
+	Key    string        `json:"k"`
+}
+
+func normalize(value interface{}) (interface{}, error) {
+	blob, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normal interface{}
+	if err := json.Unmarshal(blob, &normal); err != nil {
+		return nil, err
+	}
+	return normal, nil
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return ""
+}
+
+// Validate checks field names and operators, and converts filter values to
+// the types JSON decoding produces.
+func (q *Query) Validate() error {
+	for i, filter := range q.Filters {
+		if filter.Op == "" {
+			filter.Op = "eq"
+		}
+		if !queryOps[filter.Op] || !fieldPattern.MatchString(filter.Field) {
+			return fmt.Errorf("%s Unknown filter %s %s", ErrBadQuery, filter.Field, filter.Op)
+		}
+		value, err := normalize(filter.Value)
+		if err != nil {
+			return err
+		}
+		if jsonType(value) == "" || (filter.Field == "key" && jsonType(value) != "string") {
+			return fmt.Errorf("%s Filter values must be strings, numbers or booleans.", ErrBadQuery)
+		}
+		filter.Value = value
+		q.Filters[i] = filter
+	}
+	for _, field := range q.Sort {
+		if !fieldPattern.MatchString(field.Field) {
+			return fmt.Errorf("%s Unknown sort field %s", ErrBadQuery, field.Field)
+		}
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return ErrBadQuery
+	}
+	_, _, err := q.Cursor()
+	return err
+}
+
+// Cursor decodes After into the sort values and key of the last object of
+// the previous page.  It returns a nil slice if After is empty.
+func (q *Query) Cursor() ([]interface{}, string, error) {
+	if q.After == "" {
+		return nil, "", nil
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(q.After)
+	if err != nil {
+		return nil, "", ErrBadCursor
+	}
+	after := &cursor{}
+	if err := json.Unmarshal(blob, after); err != nil || len(after.Values) != len(q.Sort) {
+		return nil, "", ErrBadCursor
+	}
+	return after.Values, after.Key, nil
+}
+
+func (q *Query) cursor(record *Record) (string, error) {
+	var data interface{}
+	if err := json.Unmarshal(record.Data, &data); err != nil {
+		return "", err
+	}
+	next := &cursor{Values: make([]interface{}, len(q.Sort)), Key: record.Key}
+	for i, field := range q.Sort {
+		next.Values[i], _ = fieldValue(record.Key, data, field.Field)
+	}
+	blob, err := json.Marshal(next)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+// ParseQuery reads a query from URL parameters: sort (comma separated fields,
+// descending if prefixed by -), limit, offset, after, and filters written as
+// field=value or field[op]=value.  Values that parse as JSON numbers or
+// booleans are compared as such.
+func ParseQuery(values url.Values) (*Query, error) {
+	q := &Query{}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := values.Get(name)
+		switch name {
+		case "sort":
+			for _, field := range splitList(value) {
+				q.Sort = append(q.Sort, Sort{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")})
+			}
+		case "limit", "offset":
+			num, err := strconv.Atoi(value)
+			if err != nil || num < 0 {
+				return nil, fmt.Errorf("%s Invalid %s: %s", ErrBadQuery, name, value)
+			}
+			if name == "limit" {
+				q.Limit = num
+			} else {
+				q.Offset = num
+			}
+		case "after":
+			q.After = value
+		default:
+			filter := Filter{Field: name, Op: "eq", Value: value}
+			if open := strings.Index(name, "["); open > 0 && strings.HasSuffix(name, "]") {
+				filter.Field = name[:open]
+				filter.Op = name[open+1 : len(name)-1]
+			}
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(value), &parsed); err == nil && filter.Field != "key" {
+				if kind := jsonType(parsed); kind == "number" || kind == "boolean" {
+					filter.Value = parsed
+				}
+			}
+			q.Filters = append(q.Filters, filter)
+		}
+	}
+	if q.Limit > maxQueryLimit {
+		q.Limit = maxQueryLimit
+	}
+	return q, q.Validate()
+}
+
+// RouteQuery builds the query for a route.  The route's "query" setting is a
+// URL query string of fixed parameters, and its "params" setting lists the
+// parameters the request URL may set or override.
+func (a *App) RouteQuery(route map[string]string, params url.Values) (*Query, error) {
+	values, err := url.ParseQuery(route["query"])
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool)
+	for _, name := range splitList(route["params"]) {
+		allowed[name] = true
+	}
+	for name, value := range params {
+		field := name
+		if open := strings.Index(name, "["); open > 0 {
+			field = name[:open]
+		}
+		if allowed[field] {
+			values[name] = value
+		}
+	}
+	return ParseQuery(values)
+}
+
+func fieldValue(key string, data interface{}, field string) (interface{}, bool) {
+	if field == "key" {
+		return key, true
+	}
+	for _, name := range strings.Split(field, ".") {
+		fields, ok := data.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if data, ok = fields[name]; !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// compareValues orders missing and null values first, then booleans,
+// numbers, strings and anything else.
+func compareValues(a interface{}, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		if a < b.(float64) {
+			return -1
+		} else if a > b.(float64) {
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+func matchFilter(key string, data interface{}, filter Filter) bool {
+	value, ok := fieldValue(key, data, filter.Field)
+	if !ok || jsonType(value) != jsonType(filter.Value) {
+		return false
+	}
+	cmp := compareValues(value, filter.Value)
+	switch filter.Op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	}
+	return false
+}
+
+type queryRow struct {
+	record Record
+	values []interface{}
+}
+
+func compareRows(q *Query, a []interface{}, keyA string, b []interface{}, keyB string) int {
+	for i, field := range q.Sort {
+		if cmp := compareValues(a[i], b[i]); cmp != 0 {
+			if field.Desc {
+				return -cmp
+			}
+			return cmp
+		}
+	}
+	return strings.Compare(keyA, keyB)
+}
+
+// queryRecords runs q over records in memory for drivers that are not
+// Queriers.
+func queryRecords(records []Record, q *Query) ([]Record, error) {
+	afterValues, afterKey, err := q.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]queryRow, 0)
+	for _, record := range records {
+		var data interface{}
+		if err := json.Unmarshal(record.Data, &data); err != nil {
+			return nil, err
+		}
+		matched := true
+		for _, filter := range q.Filters {
+			if matched = matchFilter(record.Key, data, filter); !matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		row := queryRow{record: record, values: make([]interface{}, len(q.Sort))}
+		for i, field := range q.Sort {
+			row.values[i], _ = fieldValue(record.Key, data, field.Field)
+		}
+		if afterValues != nil && compareRows(q, row.values, record.Key, afterValues, afterKey) <= 0 {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compareRows(q, rows[i].values, rows[i].record.Key, rows[j].values, rows[j].record.Key) < 0
+	})
+	if q.Offset >= len(rows) {
+		return []Record{}, nil
+	}
+	rows = rows[q.Offset:]
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+	}
+	result := make([]Record, len(rows))
+	for i, row := range rows {
+		result[i] = row.record
+	}
+	return result, nil
+}
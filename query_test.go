@@ -0,0 +1,119 @@
+//    Title: query_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+var queryObjects = map[string]string{
+	"a": `{"score":3,"tag":"x"}`,
+	"b": `{"score":1,"tag":"y"}`,
+	"c": `{"tag":"x"}`,
+	"d": `{"score":3,"tag":"y"}`,
+	"f": `{"score":2,"meta":{"rank":5}}`,
+	"g": `{"score":0,"tag":1}`,
+}
+
+// queryKeys runs the query every page at a time and returns the keys found.
+func queryKeys(t *testing.T, db *Database, params string) []string {
+	t.Helper()
+	values, err := url.ParseQuery(params)
+	mustStore(t, err)
+	q, err := ParseQuery(values)
+	mustStore(t, err)
+	keys := []string{}
+	for page := 0; ; page++ {
+		records, next, err := db.QueryRecords(context.Background(), "posts", q)
+		mustStore(t, err)
+		for _, record := range records {
+			keys = append(keys, record.Key)
+		}
+		if next == "" {
+			return keys
+		}
+		if page > len(queryObjects) {
+			t.Fatalf("%s: the cursor does not advance", params)
+		}
+		q.After = next
+	}
+}
+
+// TestQueryDrivers checks that queries pushed down to SQL select the same
+// objects in the same order as queries run in memory.
+func TestQueryDrivers(t *testing.T) {
+	tests := []struct {
+		params string
+		keys   []string
+	}{
+		{"", []string{"a", "b", "c", "d", "f", "g"}},
+		{"score[gte]=2", []string{"a", "d", "f"}},
+		{"tag=x", []string{"a", "c"}},
+		{"tag[ne]=x", []string{"b", "d"}},
+		{"key[gt]=c", []string{"d", "f", "g"}},
+		{"meta.rank[lt]=10", []string{"f"}},
+		{"sort=score", []string{"c", "g", "b", "f", "a", "d"}},
+		{"sort=-score", []string{"a", "d", "f", "b", "g", "c"}},
+		{"sort=score&limit=4", []string{"c", "g", "b", "f", "a", "d"}},
+		{"sort=-score&limit=2", []string{"a", "d", "f", "b", "g", "c"}},
+		{"sort=meta.rank&limit=1", []string{"a", "b", "c", "d", "g", "f"}},
+		{"sort=-meta.rank&limit=2", []string{"f", "a", "b", "c", "d", "g"}},
+		{"sort=tag,-score&limit=1", []string{"f", "g", "a", "c", "d", "b"}},
+		{"sort=score&offset=2", []string{"b", "f", "a", "d"}},
+		{"sort=-score&tag[ne]=z&limit=1", []string{"a", "d", "b", "c"}},
+	}
+	for driver, params := range testStoreParams {
+		t.Run(driver, func(t *testing.T) {
+			db, err := NewApp().NewDatabase(driver, params(t.TempDir()))
+			mustStore(t, err)
+			defer db.Close()
+			ctx := context.Background()
+			mustStore(t, db.CreateTable(ctx, "posts"))
+			for key, data := range queryObjects {
+				var value interface{}
+				mustStore(t, json.Unmarshal([]byte(data), &value))
+				mustStore(t, db.InsertObj(ctx, "posts", key, value))
+			}
+			for _, test := range tests {
+				if keys := queryKeys(t, db, test.params); !reflect.DeepEqual(keys, test.keys) {
+					t.Errorf("%q: got %v, want %v", test.params, keys, test.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestParseQueryRejects(t *testing.T) {
+	for _, params := range []string{
+		"limit=-1",
+		"offset=two",
+		"score[like]=1",
+		"sort=a%3Bb",
+		"bad field=1",
+		"sort=score&after=garbage",
+	} {
+		values, err := url.ParseQuery(params)
+		mustStore(t, err)
+		if _, err := ParseQuery(values); err == nil {
+			t.Errorf("ParseQuery(%q) accepted it", params)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+//    Title: recovery.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	verifyTokenAge = 24 * time.Hour
+	resetTokenAge  = time.Hour
+)
+
+var ErrBadToken = errors.New("Invalid or expired token.")
+
+// Tokens are bound to a field of the user record that changes once the token
+// has served its purpose: the email for verification and the salt for resets.
+func (a *App) NewToken(kind string, username string, bound string, age time.Duration) (string, error) {
+	return a.Scook.Encode(kind, map[string]string{
+		"username": username,
+		"bound":    bound,
+		"expires":  strconv.FormatInt(time.Now().Add(age).Unix(), 10),
+	})
+}
+
+func (a *App) ReadToken(ctx context.Context, kind string, token string) (*User, string, error) {
+	value := make(map[string]string)
+	if err := a.Scook.Decode(kind, token, &value); err != nil {
+		return nil, "", ErrBadToken
+	}
+	expires, err := strconv.ParseInt(value["expires"], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, "", ErrBadToken
+	}
+	user, err := a.GetUser(ctx, value["username"])
+	if err != nil {
+		return nil, "", ErrBadToken
+	}
+	return user, value["bound"], nil
+}
+
+func (a *App) SendVerification(user *User) error {
+	if a.Mailer == nil {
+		return nil
+	}
+	token, err := a.NewToken("verify", user.Username, user.Email, verifyTokenAge)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/verify?token=%s", a.Baseurl, url.QueryEscape(token))
+	body := fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by visiting the link below.\n\n%s\n\nThe link expires in %s.", user.Username, link, verifyTokenAge)
+	return a.Mailer.Send(user.Email, "Confirm your email address", body)
+}
+
+func (a *App) SendPasswordReset(user *User) error {
+	if a.Mailer == nil {
+		return errors.New("No mailer configured.")
+	}
+	token, err := a.NewToken("reset", user.Username, user.Salt, resetTokenAge)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/?reset=%s", a.Baseurl, url.QueryEscape(token))
+	body := fmt.Sprintf("Hello %s,\n\nA password reset was requested for your account.  Visit the link below to choose a new password.\n\n%s\n\nThe link expires in %s.  If you did not request a reset you can ignore this message.", user.Username, link, resetTokenAge)
+	return a.Mailer.Send(user.Email, "Reset your password", body)
+}
+
+func (a *App) VerifyEmail(ctx context.Context, token string) (*User, error) {
+	user, bound, err := a.ReadToken(ctx, "verify", token)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != bound {
+		return nil, ErrBadToken
+	}
+	if user.Verified {
+		return user, nil
+	}
+	user.Verified = true
+	if err := a.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.Emitter.Emit("emailverified", user.Username, user.Email)
+	return user, nil
+}
+
+func (a *App) ResetPassword(ctx context.Context, token string, password string) (*User, error) {
+	user, bound, err := a.ReadToken(ctx, "reset", token)
+	if err != nil {
+		return nil, err
+	}
+	if user.Salt != bound {
+		return nil, ErrBadToken
+	}
+	salt, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	user.Salt = salt
+	user.Passhash = hashPassword(user.Username, user.Email, password, salt)
+	if err := a.rotateSession(user); err != nil {
+		return nil, err
+	}
+	user.TokenGeneration++
+	if err := a.SaveUser(ctx, user); err != nil {
+		return nil, err
+	}
+	a.EndSessions(user.Username, "")
+	if err := a.deleteAPIKeys(ctx, user.Username); err != nil {
+		log.Println("error revoking API keys: ", err)
+	}
+	a.Emitter.Emit("passwordreset", user.Username)
+	return user, nil
+}
+
+func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if _, err := a.VerifyEmail(r.Context(), r.FormValue("token")); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	http.Redirect(w, r, "/", 303)
+}
+
+func (a *App) ForgotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	username := r.FormValue("username")
+	wait, err := a.Limiter.Throttle(r.Context(), "reset", username, a.RemoteAddr(r))
+	if err != nil {
+		WriteError(w, 500, "Could not check reset requests.", nil)
+		return
+	}
+	if wait > 0 {
+		seconds := setRetryAfter(w, wait)
+		WriteError(w, 429, fmt.Sprintf("Too many reset requests, try again in %d seconds.", seconds), nil)
+		return
+	}
+	// The reply never reveals whether the user exists.
+	if user, err := a.GetUser(r.Context(), username); err == nil && user.Email != "" {
+		if err := a.SendPasswordReset(user); err != nil {
+			log.Println("error sending password reset: ", err)
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func (a *App) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, 405, "Invalid request method.", nil)
+		return
+	}
+	errs := make(FieldErrors)
+	a.Rules.CheckPassword(errs, "password", r.FormValue("password"))
+	if len(errs) > 0 {
+		WriteError(w, 400, "Invalid request.", errs)
+		return
+	}
+	user, err := a.ResetPassword(r.Context(), r.FormValue("token"), r.FormValue("password"))
+	if err == ErrBadToken {
+		WriteError(w, 400, err.Error(), FieldErrors{"token": err.Error()})
+		return
+	} else if err != nil {
+		WriteError(w, 500, "Could not reset password.", nil)
+		return
+	}
+	a.SetCookieHandler(w, r, a.Cookiename, a.SessionCookie(user))
+	w.WriteHeader(200)
+}
@@ -0,0 +1,166 @@
+//    Title: recovery_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type sentMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// recordingMailer keeps the mail it is asked to send.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *recordingMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentMail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// take returns the mail sent since the last call.
+func (m *recordingMailer) take() []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := m.sent
+	m.sent = nil
+	return sent
+}
+
+// mailedToken returns the token of the link named param in body.
+func mailedToken(t *testing.T, body string, param string) string {
+	t.Helper()
+	match := regexp.MustCompile(param + `=(\S+)`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("no %s link in %q", param, body)
+	}
+	token, err := url.QueryUnescape(match[1])
+	mustStore(t, err)
+	return token
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func recoveryApp(t *testing.T) (*App, *recordingMailer) {
+	t.Helper()
+	a := accountApp(t, authPassword, false)
+	mustStore(t, a.DB.CreateTable(context.Background(), apikeyTable))
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	a.Baseurl = "https://example.com"
+	a.Limiter.BaseDelay = 0
+	a.Limiter.MaxDelay = 0
+	return a, mailer
+}
+
+func TestPasswordResetByMail(t *testing.T) {
+	a, mailer := recoveryApp(t)
+	if w := postForm(a.ForgotHandler, "/forgot", url.Values{"username": {"ann"}}); w.Code != 200 {
+		t.Fatalf("forgot for an unknown user answered %d", w.Code)
+	}
+	if sent := mailer.take(); len(sent) != 0 {
+		t.Fatalf("mail sent for an unknown user: %v", sent)
+	}
+	if w := postForm(a.ForgotHandler, "/forgot", url.Values{"username": {"jon"}}); w.Code != 200 {
+		t.Fatalf("forgot answered %d", w.Code)
+	}
+	sent := mailer.take()
+	if len(sent) != 1 || sent[0].To != "jon@example.com" || !strings.Contains(sent[0].Body, "https://example.com/?reset=") {
+		t.Fatalf("sent %v, want one reset link to jon@example.com", sent)
+	}
+	token := mailedToken(t, sent[0].Body, "reset")
+	tests := []struct {
+		name     string
+		token    string
+		password string
+		code     int
+	}{
+		{"bad token", "garbage", "Another password 2", 400},
+		{"weak password", token, "short", 400},
+		{"reset", token, "Another password 2", 200},
+		{"used token", token, "Third password 3", 400},
+	}
+	for _, test := range tests {
+		if w := postForm(a.ResetHandler, "/reset", url.Values{"token": {test.token}, "password": {test.password}}); w.Code != test.code {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.code)
+		}
+	}
+	if _, err := a.Authenticate(context.Background(), "jon", "Another password 2"); err != nil {
+		t.Fatalf("the new password does not log in: %s", err)
+	}
+}
+
+func TestEmailVerificationByMail(t *testing.T) {
+	ctx := context.Background()
+	a, mailer := recoveryApp(t)
+	user, err := a.GetUser(ctx, "jon")
+	mustStore(t, err)
+	mustStore(t, a.SendVerification(user))
+	sent := mailer.take()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d mails, want 1", len(sent))
+	}
+	old := mailedToken(t, sent[0].Body, "token")
+	_, err = a.ChangeEmail(ctx, "jon", authPassword, "jon@example.org", "")
+	mustStore(t, err)
+	sent = mailer.take()
+	if len(sent) != 1 || sent[0].To != "jon@example.org" {
+		t.Fatalf("sent %v, want a link to the new address", sent)
+	}
+	tests := []struct {
+		name     string
+		token    string
+		code     int
+		verified bool
+	}{
+		{"link to the old address", old, 400, false},
+		{"bad token", "garbage", 400, false},
+		{"link to the new address", mailedToken(t, sent[0].Body, "token"), 303, true},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		a.VerifyHandler(w, httptest.NewRequest("GET", "/verify?token="+url.QueryEscape(test.token), nil))
+		if w.Code != test.code {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.code)
+		}
+		user, err := a.GetUser(ctx, "jon")
+		mustStore(t, err)
+		if user.Verified != test.verified {
+			t.Errorf("%s: verified %v, want %v", test.name, user.Verified, test.verified)
+		}
+	}
+}
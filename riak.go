@@ -0,0 +1,273 @@
+//    Title: riak.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tpjg/goriakpbc"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// RiakStore keeps each table in a bucket.  Riak has no multi-key
+// transactions, so RiakStore does not implement Transactor.
+//
+// Indexes are riak secondary indexes, which need the leveldb backend.  They
+// are set as objects are written, so objects written before an index was
+// declared are not found through it until they are written again.
+//
+// The riak client takes no context, so a cancelled context stops an operation
+// before its next request but cannot interrupt a request in flight.
+type RiakStore struct {
+	Buckets map[string]*riak.Bucket
+	Indexes map[string][]*Index
+	mu      sync.RWMutex
+}
+
+func init() {
+	RegisterDriver("riak", func() Store {
+		return &RiakStore{Buckets: make(map[string]*riak.Bucket), Indexes: make(map[string][]*Index)}
+	})
+}
+
+func (s *RiakStore) bucket(table string) (*riak.Bucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bucket, exists := s.Buckets[table]
+	if !exists {
+		return nil, ErrNoTable
+	}
+	return bucket, nil
+}
+
+func (s *RiakStore) Open(ctx context.Context, params map[string]string) error {
+	if err := riak.ConnectClient(fmt.Sprintf("%s:%s", params["host"], params["port"])); err != nil {
+		return errors.New("Cannot connect, is Riak running?")
+	}
+	return nil
+}
+
+func (s *RiakStore) CreateTable(ctx context.Context, table string) error {
+	bucket, err := riak.NewBucket(table)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.Buckets[table] = bucket
+	s.mu.Unlock()
+	return nil
+}
+
+func riakVersion(obj *riak.RObject) int64 {
+	if version, err := strconv.ParseInt(obj.Meta["version"], 10, 64); err == nil {
+		return version
+	}
+	return 1
+}
+
+func (s *RiakStore) fetch(ctx context.Context, table string, key string) (*riak.Bucket, *riak.RObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	bucket, err := s.bucket(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists, _ := bucket.Exists(key); !exists {
+		return bucket, nil, ErrNotFound
+	}
+	obj, err := bucket.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bucket, obj, nil
+}
+
+func (s *RiakStore) Get(ctx context.Context, table string, key string) (*Record, error) {
+	_, obj, err := s.fetch(ctx, table, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Key: key, Data: obj.Data, Version: riakVersion(obj)}, nil
+}
+
+func (s *RiakStore) All(ctx context.Context, table string) ([]Record, error) {
+	bucket, err := s.bucket(table)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		record, err := s.Get(ctx, table, string(key))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+// Scan lists the keys of the bucket and fetches the objects one at a time.
+// Objects deleted after the keys were listed are skipped.
+func (s *RiakStore) Scan(ctx context.Context, table string, fn func(record *Record) error) error {
+	bucket, err := s.bucket(table)
+	if err != nil {
+		return err
+	}
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		record, err := s.Get(ctx, table, string(key))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RiakStore) store(table string, obj *riak.RObject, data []byte, version int64) error {
+	obj.ContentType = "application/json"
+	obj.Data = data
+	if obj.Meta == nil {
+		obj.Meta = make(map[string]string)
+	}
+	obj.Meta["version"] = strconv.FormatInt(version, 10)
+	s.mu.RLock()
+	indexes := s.Indexes[table]
+	s.mu.RUnlock()
+	if len(indexes) > 0 {
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		obj.Indexes = make(map[string][]string)
+		for _, index := range indexes {
+			if field, ok := fieldValue(obj.Key, value, index.Field); ok && jsonType(field) != "" {
+				obj.Indexes[index.Name()+"_bin"] = []string{jsonArg(field).(string)}
+			}
+		}
+	}
+	return obj.Store()
+}
+
+func (s *RiakStore) Insert(ctx context.Context, table string, key string, data []byte) error {
+	bucket, obj, err := s.fetch(ctx, table, key)
+	if err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return err
+	}
+	obj = bucket.NewObject(key)
+	return s.store(table, obj, data, 1)
+}
+
+// Riak has no compare-and-set, so the version check and the write are two
+// steps.  The fetched vector clock is written back, which lets riak keep
+// siblings rather than silently dropping a racing write.
+func (s *RiakStore) Update(ctx context.Context, table string, key string, data []byte, version int64) (int64, error) {
+	_, obj, err := s.fetch(ctx, table, key)
+	if err != nil {
+		return 0, err
+	}
+	current := riakVersion(obj)
+	if version != 0 && version != current {
+		return 0, ErrConflict
+	}
+	if err := s.store(table, obj, data, current+1); err != nil {
+		return 0, err
+	}
+	return current + 1, nil
+}
+
+func (s *RiakStore) Upsert(ctx context.Context, table string, key string, data []byte) (int64, error) {
+	bucket, obj, err := s.fetch(ctx, table, key)
+	if err == ErrNotFound {
+		return 1, s.store(table, bucket.NewObject(key), data, 1)
+	} else if err != nil {
+		return 0, err
+	}
+	current := riakVersion(obj)
+	return current + 1, s.store(table, obj, data, current+1)
+}
+
+func (s *RiakStore) Delete(ctx context.Context, table string, key string, version int64) error {
+	bucket, obj, err := s.fetch(ctx, table, key)
+	if err == ErrNotFound && version == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if version != 0 && version != riakVersion(obj) {
+		return ErrConflict
+	}
+	return bucket.Delete(key)
+}
+
+// CreateIndex fails with ErrNoUnique for unique indexes: riak cannot check
+// a value and write it atomically, so two writers could both claim it.
+func (s *RiakStore) CreateIndex(ctx context.Context, index *Index) error {
+	if index.Unique {
+		return ErrNoUnique
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Indexes[index.Table] = append(s.Indexes[index.Table], index)
+	return nil
+}
+
+func (s *RiakStore) Find(ctx context.Context, index *Index, value interface{}) ([]Record, error) {
+	bucket, err := s.bucket(index.Table)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := bucket.IndexQuery(index.Name()+"_bin", jsonArg(value).(string))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		record, err := s.Get(ctx, index.Table, key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+func (s *RiakStore) Close() error {
+	riak.Close()
+	return nil
+}
@@ -57,7 +57,10 @@ func (r *Room) Start() {
 				Payload:       payload,
 			}
 			r.Members[c.Id] = c
-			c.Send <- MessageToBytes(msg)
+			if !c.offer(MessageToBytes(msg)) {
+				delete(r.Members, c.Id)
+				c.Close()
+			}
 		case c := <-r.Leavechan:
 			if _, ok := r.Members[c.Id]; ok {
 				msg := &Message{
@@ -73,18 +76,21 @@ func (r *Room) Start() {
 					Payload:       []byte(c.Id),
 				}
 				delete(r.Members, c.Id)
-				c.Send <- MessageToBytes(msg)
+				if !c.offer(MessageToBytes(msg)) {
+					c.Close()
+				}
 			}
 		case msg := <-r.Send:
+			if r.Application.Messages.Persists(r.Name) {
+				r.Application.Messages.Record(r.Name, msg.Sender, msg.Data)
+			}
 			for id, c := range r.Members {
 				if c == msg.Sender {
 					continue
 				}
-				select {
-				case c.Send <- msg.Data:
-				default:
+				if !c.offer(msg.Data) {
 					delete(r.Members, id)
-					close(c.Send)
+					c.Close()
 				}
 			}
 		case <-r.Stopchan:
@@ -17,8 +17,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/gojonnygo/rtgo"
 	"io"
 	"io/ioutil"
 	"log"
@@ -38,6 +40,7 @@ var (
 	del        = flag.Bool("del", false, "Delete either a view or controller.")
 	view       = flag.String("view", "", "The name of the view to add or delete.")
 	controller = flag.String("controller", "", "The name of the controller to add or delete.")
+	config     = flag.String("config", "./config.json", "The config file used by migrate, export and import.")
 )
 
 func CopyFile(source string, dest string) error {
@@ -179,8 +182,62 @@ func AddView(name string) error {
 	return nil
 }
 
+// loadApp reads the app's configuration for the commands that work on its
+// databases.
+func loadApp() (*rtgo.App, error) {
+	file, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return nil, err
+	}
+	app := rtgo.NewApp()
+	if err := json.Unmarshal(file, app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// Migrate runs the SQL migrations of a configured database.  Migrations
+// written in Go are only known to the application, which runs them with
+// App.MigrateCommand.
+func Migrate(args []string) error {
+	app, err := loadApp()
+	if err != nil {
+		return err
+	}
+	return app.MigrateCommand(args, os.Stdout)
+}
+
+// Export writes a table of a configured database to stdout as JSON Lines.
+func Export(args []string) error {
+	app, err := loadApp()
+	if err != nil {
+		return err
+	}
+	return app.ExportCommand(args, os.Stdout)
+}
+
+// Import reads a table written by Export from stdin.
+func Import(args []string) error {
+	app, err := loadApp()
+	if err != nil {
+		return err
+	}
+	return app.ImportCommand(args, os.Stdin, os.Stderr)
+}
+
 func main() {
 	flag.Parse()
+	commands := map[string]func([]string) error{
+		"migrate": Migrate,
+		"export":  Export,
+		"import":  Import,
+	}
+	if command, ok := commands[flag.Arg(0)]; ok {
+		if err := command(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *create {
 		if err := CreateNewProject(); err != nil {
 			log.Fatal(err)
@@ -0,0 +1,925 @@
+//    Title: sql.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConnectRetries = 5
+	defaultRetryDelay     = time.Second
+	maxRetryDelay         = 30 * time.Second
+)
+
+type Dialect struct {
+	Driver       string
+	Quote        func(name string) string
+	Dsn          func(params map[string]string) string
+	Create       string
+	Upsert       string
+	Placeholder  func(n int) string
+	Field        func(path string) string
+	Value        func(n int) string
+	Arg          func(value interface{}) interface{}
+	Type         func(path string, kind string) string
+	Init         []string
+	Index        func(index *Index) string
+	Generated    func(index *Index) string
+	IndexExists  string
+	ColumnExists string
+	Lookup       func(index *Index, n int) string
+	// DDLCommits is set for databases that commit the open transaction
+	// at every schema change.
+	DDLCommits bool
+}
+
+// SQLStore runs its operations against Connection, or against Tx when it was
+// returned by Begin.
+type SQLStore struct {
+	Dialect    *Dialect
+	Connection *sql.DB
+	Tx         *sql.Tx
+}
+
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var errInTx = errors.New("Not allowed inside a transaction.")
+
+// quoteWith returns a function quoting identifiers with the given quote
+// character, doubling any that appear inside the name.
+func quoteWith(quote string) func(name string) string {
+	return func(name string) string {
+		return quote + strings.Replace(name, quote, quote+quote, -1) + quote
+	}
+}
+
+var (
+	doubleQuote = quoteWith(`"`)
+	backQuote   = quoteWith("`")
+)
+
+var (
+	Postgres = &Dialect{
+		Driver: "postgres",
+		Quote:  doubleQuote,
+		Dsn: func(params map[string]string) string {
+			return fmt.Sprintf("dbname=%s user=%s password=%s host=%s sslmode=%s fallback_application_name=%s connect_timeout=%s sslcert=%s sslkey=%s sslrootcert=%s", params["dbname"], params["user"], params["password"], params["host"], params["sslmode"], params["fallback_application_name"], params["connect_timeout"], params["sslcert"], params["sslkey"], params["sslrootcert"])
+		},
+		Create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BYTEA, version BIGINT NOT NULL DEFAULT 1, expires BIGINT, deleted BIGINT)",
+		Upsert: "INSERT INTO %[1]s (hash, data, expires) VALUES ($1, $2, $3) ON CONFLICT (hash) DO UPDATE SET data = EXCLUDED.data, version = %[1]s.version + 1, expires = COALESCE(EXCLUDED.expires, %[1]s.expires)",
+		Placeholder: func(n int) string {
+			return "$" + strconv.Itoa(n)
+		},
+		Field: func(path string) string {
+			return fmt.Sprintf("(rtgo_json(data) #> '{%s}')", strings.Replace(path, ".", ",", -1))
+		},
+		Value: func(n int) string {
+			return "$" + strconv.Itoa(n) + "::jsonb"
+		},
+		Arg: jsonArg,
+		Type: func(path string, kind string) string {
+			return fmt.Sprintf("jsonb_typeof(rtgo_json(data) #> '{%s}') = '%s'", strings.Replace(path, ".", ",", -1), kind)
+		},
+		Init: []string{
+			"CREATE OR REPLACE FUNCTION rtgo_json(data BYTEA) RETURNS JSONB AS $$ SELECT convert_from(data, 'UTF8')::jsonb $$ LANGUAGE SQL IMMUTABLE",
+		},
+		Index: func(index *Index) string {
+			return fmt.Sprintf("CREATE %sINDEX %s ON %s ((rtgo_json(data) #> '{%s}'))", unique(index), doubleQuote(index.Name()), doubleQuote(index.Table), strings.Replace(index.Field, ".", ",", -1))
+		},
+		IndexExists:  "SELECT COUNT(*) FROM pg_indexes WHERE tablename = $1 AND indexname = $2",
+		ColumnExists: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2",
+		Lookup: func(index *Index, n int) string {
+			return fmt.Sprintf("(rtgo_json(data) #> '{%s}') = $%d::jsonb", strings.Replace(index.Field, ".", ",", -1), n)
+		},
+	}
+	Mysql = &Dialect{
+		Driver: "mysql",
+		Quote:  backQuote,
+		Dsn: func(params map[string]string) string {
+			return fmt.Sprintf("%s:%s@%s/%s?allowAllFiles=%s&allowCleartextPasswords=%s&allowOldPasswords=%s&charset=%s&collation=%s&clientFoundRows=%s&loc=%s&parseTime=%s&strict=%s&timeout=%s&tls=%s", params["user"], params["password"], params["host"], params["dbname"], params["allowAllFiles"], params["allowCleartextPasswords"], params["allowOldPasswords"], params["charset"], params["collation"], params["clientFoundRows"], params["loc"], params["parseTime"], params["strict"], params["timeout"], params["tls"])
+		},
+		Create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data LONGBLOB, version BIGINT NOT NULL DEFAULT 1, expires BIGINT, deleted BIGINT)",
+		Upsert: "INSERT INTO %s (hash, data, expires) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), version = version + 1, expires = COALESCE(VALUES(expires), expires)",
+		Placeholder: func(n int) string {
+			return "?"
+		},
+		Field: func(path string) string {
+			return fmt.Sprintf("JSON_EXTRACT(CONVERT(data USING utf8mb4), '$.%s')", path)
+		},
+		Value: func(n int) string {
+			return "CAST(? AS JSON)"
+		},
+		Arg: jsonArg,
+		Type: func(path string, kind string) string {
+			types := map[string]string{
+				"boolean": "'BOOLEAN'",
+				"number":  "'INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL'",
+				"string":  "'STRING'",
+			}
+			return fmt.Sprintf("JSON_TYPE(JSON_EXTRACT(CONVERT(data USING utf8mb4), '$.%s')) IN (%s)", path, types[kind])
+		},
+		Index: func(index *Index) string {
+			return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique(index), backQuote(index.Name()), backQuote(index.Table), backQuote(index.Name()))
+		},
+		Generated: func(index *Index) string {
+			return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s VARCHAR(255) AS (CAST(JSON_EXTRACT(CONVERT(data USING utf8mb4), '$.%s') AS CHAR(255))) VIRTUAL", backQuote(index.Table), backQuote(index.Name()), index.Field)
+		},
+		IndexExists:  "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+		ColumnExists: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+		DDLCommits:   true,
+		Lookup: func(index *Index, n int) string {
+			return backQuote(index.Name()) + " = ?"
+		},
+	}
+	Sqlite3 = &Dialect{
+		Driver: "sqlite3",
+		Quote:  doubleQuote,
+		Dsn: func(params map[string]string) string {
+			return params["file"]
+		},
+		Create: "CREATE TABLE IF NOT EXISTS %s (hash VARCHAR(255) NOT NULL UNIQUE PRIMARY KEY, data BLOB, version BIGINT NOT NULL DEFAULT 1, expires BIGINT, deleted BIGINT)",
+		Upsert: "INSERT INTO %s (hash, data, expires) VALUES (?, ?, ?) ON CONFLICT (hash) DO UPDATE SET data = excluded.data, version = version + 1, expires = COALESCE(excluded.expires, expires)",
+		Placeholder: func(n int) string {
+			return "?"
+		},
+		Field: func(path string) string {
+			return fmt.Sprintf("json_extract(CAST(data AS TEXT), '$.%s')", path)
+		},
+		Value: func(n int) string {
+			return "?"
+		},
+		Arg: func(value interface{}) interface{} {
+			if b, ok := value.(bool); ok && b {
+				return 1
+			} else if ok {
+				return 0
+			}
+			return value
+		},
+		Type: func(path string, kind string) string {
+			types := map[string]string{
+				"boolean": "'true', 'false'",
+				"number":  "'integer', 'real'",
+				"string":  "'text'",
+			}
+			return fmt.Sprintf("json_type(CAST(data AS TEXT), '$.%s') IN (%s)", path, types[kind])
+		},
+		Index: func(index *Index) string {
+			return fmt.Sprintf("CREATE %sINDEX %s ON %s (json_extract(CAST(data AS TEXT), '$.%s'))", unique(index), doubleQuote(index.Name()), doubleQuote(index.Table), index.Field)
+		},
+		IndexExists:  "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?",
+		ColumnExists: "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+		Lookup: func(index *Index, n int) string {
+			return fmt.Sprintf("json_extract(CAST(data AS TEXT), '$.%s') = ?", index.Field)
+		},
+	}
+)
+
+func unique(index *Index) string {
+	if index.Unique {
+		return "UNIQUE "
+	}
+	return ""
+}
+
+func jsonArg(value interface{}) interface{} {
+	blob, _ := json.Marshal(value)
+	return string(blob)
+}
+
+func init() {
+	for _, dialect := range []*Dialect{Postgres, Mysql, Sqlite3} {
+		dialect := dialect
+		RegisterDriver(dialect.Driver, func() Store {
+			return &SQLStore{Dialect: dialect}
+		})
+	}
+}
+
+// Open configures the connection pool and pings the server until it answers,
+// waiting retry_delay after the first failure and twice as long after each
+// further one, so that a wrong DSN fails at startup rather than on the first
+// query.
+func (s *SQLStore) Open(ctx context.Context, params map[string]string) error {
+	if s.Tx != nil {
+		return errInTx
+	}
+	var (
+		maxOpen  int
+		lifetime time.Duration
+		idleTime time.Duration
+	)
+	maxIdle := 2
+	retries := defaultConnectRetries
+	delay := defaultRetryDelay
+	ints := map[string]*int{
+		"max_open_conns":  &maxOpen,
+		"max_idle_conns":  &maxIdle,
+		"connect_retries": &retries,
+	}
+	for key, dest := range ints {
+		if val, ok := params[key]; ok {
+			num, err := strconv.Atoi(val)
+			if err != nil || num < 0 {
+				return fmt.Errorf("Invalid database value for %s: %s", key, val)
+			}
+			*dest = num
+		}
+	}
+	durations := map[string]*time.Duration{
+		"conn_max_lifetime":  &lifetime,
+		"conn_max_idle_time": &idleTime,
+		"retry_delay":        &delay,
+	}
+	for key, dest := range durations {
+		if val, ok := params[key]; ok {
+			duration, err := time.ParseDuration(val)
+			if err != nil || duration < 0 {
+				return fmt.Errorf("Invalid database value for %s: %s", key, val)
+			}
+			*dest = duration
+		}
+	}
+	dbconn, err := sql.Open(s.Dialect.Driver, s.Dialect.Dsn(params))
+	if err != nil {
+		return err
+	}
+	dbconn.SetMaxOpenConns(maxOpen)
+	dbconn.SetMaxIdleConns(maxIdle)
+	dbconn.SetConnMaxLifetime(lifetime)
+	dbconn.SetConnMaxIdleTime(idleTime)
+	for attempt := 0; ; attempt++ {
+		if err = dbconn.PingContext(ctx); err == nil {
+			break
+		}
+		if attempt == retries {
+			dbconn.Close()
+			return fmt.Errorf("Cannot connect to %s: %s", s.Dialect.Driver, err)
+		}
+		log.Printf("cannot connect to %s, retrying in %s: %s", s.Dialect.Driver, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			dbconn.Close()
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+	s.Connection = dbconn
+	for _, statement := range s.Dialect.Init {
+		if _, err := dbconn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.Connection.PingContext(ctx)
+}
+
+func (s *SQLStore) conn() sqlConn {
+	if s.Tx != nil {
+		return s.Tx
+	}
+	return s.Connection
+}
+
+func (s *SQLStore) Begin(ctx context.Context) (TxStore, error) {
+	if s.Tx != nil {
+		return nil, errInTx
+	}
+	tx, err := s.Connection.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{Dialect: s.Dialect, Connection: s.Connection, Tx: tx}, nil
+}
+
+func (s *SQLStore) Commit() error {
+	if s.Tx == nil {
+		return sql.ErrTxDone
+	}
+	return s.Tx.Commit()
+}
+
+func (s *SQLStore) Rollback() error {
+	if s.Tx == nil {
+		return sql.ErrTxDone
+	}
+	return s.Tx.Rollback()
+}
+
+// table quotes a table name for the dialect.  Names that are not plain
+// identifiers are refused, so a table taken from a request can never change
+// the statement it is put into.
+func (s *SQLStore) table(name string) (string, error) {
+	if !ValidTable(name) {
+		return "", &TableError{Table: name, Invalid: true}
+	}
+	return s.Dialect.Quote(name), nil
+}
+
+// Exec runs a statement on the connection or transaction, for migrations and
+// other SQL the store does not cover.
+func (s *SQLStore) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.conn().ExecContext(ctx, query, args...)
+}
+
+// sqlColumns are the columns added to tables created by older versions, in
+// the order they were introduced.
+var sqlColumns = [][2]string{
+	{"version", "BIGINT NOT NULL DEFAULT 1"},
+	{"expires", "BIGINT"},
+	{"deleted", "BIGINT"},
+}
+
+// CreateTable also adds the version, expires and deleted columns to tables
+// created before records had them, and indexes expires for the reaper.
+func (s *SQLStore) CreateTable(ctx context.Context, name string) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn().ExecContext(ctx, fmt.Sprintf(s.Dialect.Create, table)); err != nil {
+		return err
+	}
+	for _, column := range sqlColumns {
+		exists, err := s.columnExists(ctx, name, column[0])
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.conn().ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column[0], column[1])); err != nil {
+			return err
+		}
+	}
+	var count int
+	index := "rtgo_" + name + "_expires"
+	if err := s.conn().QueryRowContext(ctx, s.Dialect.IndexExists, name, index).Scan(&count); err != nil || count > 0 {
+		return err
+	}
+	_, err = s.conn().ExecContext(ctx, fmt.Sprintf("CREATE INDEX %s ON %s (expires)", s.Dialect.Quote(index), table))
+	return err
+}
+
+// columnExists reports whether table has column.  It asks the catalog
+// rather than selecting the column, since a failed query aborts the
+// transaction it runs in on postgres.
+func (s *SQLStore) columnExists(ctx context.Context, table string, column string) (bool, error) {
+	var count int
+	if err := s.conn().QueryRowContext(ctx, s.Dialect.ColumnExists, table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// alive is the condition selecting records that have neither expired by the
+// time given as parameter n nor been soft deleted.
+func (s *SQLStore) alive(n int) string {
+	return fmt.Sprintf("deleted IS NULL AND (expires IS NULL OR expires > %s)", s.Dialect.Placeholder(n))
+}
+
+// purge removes the record of key if it has expired or was soft deleted, so
+// that it can be written again.
+func (s *SQLStore) purge(ctx context.Context, table string, key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE hash = %s AND NOT (%s)", table, s.Dialect.Placeholder(1), s.alive(2))
+	_, err := s.conn().ExecContext(ctx, query, key, unixMillis(time.Now()))
+	return err
+}
+
+func (s *SQLStore) Get(ctx context.Context, name string, key string) (*Record, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return nil, err
+	}
+	var expires sql.NullInt64
+	record := &Record{Key: key}
+	query := fmt.Sprintf("SELECT data, version, expires FROM %s WHERE hash = %s AND %s", table, s.Dialect.Placeholder(1), s.alive(2))
+	if err := s.conn().QueryRowContext(ctx, query, key, unixMillis(time.Now())).Scan(&record.Data, &record.Version, &expires); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	record.Expires = expires.Int64
+	return record, nil
+}
+
+func (s *SQLStore) All(ctx context.Context, name string) ([]Record, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.conn().QueryContext(ctx, fmt.Sprintf("SELECT hash, data, version, expires FROM %s WHERE %s", table, s.alive(1)), unixMillis(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+func (s *SQLStore) Scan(ctx context.Context, name string, fn func(record *Record) error) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	rows, err := s.conn().QueryContext(ctx, fmt.Sprintf("SELECT hash, data, version, expires FROM %s WHERE %s ORDER BY hash ASC", table, s.alive(1)), unixMillis(time.Now()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			record  Record
+			expires sql.NullInt64
+		)
+		if err := rows.Scan(&record.Key, &record.Data, &record.Version, &expires); err != nil {
+			return err
+		}
+		record.Expires = expires.Int64
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanRecords(rows *sql.Rows) ([]Record, error) {
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		var (
+			record  Record
+			expires sql.NullInt64
+		)
+		if err := rows.Scan(&record.Key, &record.Data, &record.Version, &expires); err != nil {
+			return nil, err
+		}
+		record.Expires = expires.Int64
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// uniqueViolation reports whether err is a driver's unique constraint error.
+func uniqueViolation(err error) bool {
+	switch err := err.(type) {
+	case sqlite3.Error:
+		return err.ExtendedCode == sqlite3.ErrConstraintUnique || err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case *pq.Error:
+		return err.Code == "23505"
+	case *mysql.MySQLError:
+		return err.Number == 1062
+	}
+	return false
+}
+
+// nullExpiry is the expires value a write sets; NULL keeps the record's
+// expiry.
+func nullExpiry(expires int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: expires, Valid: expires != 0}
+}
+
+// write runs a write query and reports a unique index refusing it as a
+// UniqueError.  Expired records keep their values in the index until they are
+// reaped, so they are reaped and the write is tried once more; soft deleted
+// records keep theirs until the reaper removes them, as with the other
+// drivers.
+func (s *SQLStore) write(ctx context.Context, name string, query string, args ...interface{}) (sql.Result, error) {
+	result, err := s.conn().ExecContext(ctx, query, args...)
+	if err == nil || !uniqueViolation(err) {
+		return result, err
+	}
+	if reaped, reapErr := s.Reap(ctx, name, 0); reapErr == nil && reaped > 0 {
+		result, err = s.conn().ExecContext(ctx, query, args...)
+		if err == nil || !uniqueViolation(err) {
+			return result, err
+		}
+	}
+	return nil, &UniqueError{Table: name, cause: err}
+}
+
+func (s *SQLStore) Insert(ctx context.Context, name string, key string, data []byte) error {
+	return s.insert(ctx, name, key, data, 0)
+}
+
+func (s *SQLStore) insert(ctx context.Context, name string, key string, data []byte, expires int64) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	if err := s.purge(ctx, table, key); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (hash, data, version, expires) VALUES (%s, %s, 1, %s)", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2), s.Dialect.Placeholder(3))
+	if _, err := s.write(ctx, name, query, key, data, nullExpiry(expires)); err != nil {
+		if _, exists := s.Get(ctx, name, key); exists == nil {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) Update(ctx context.Context, name string, key string, data []byte, version int64) (int64, error) {
+	return s.update(ctx, name, key, data, version, 0)
+}
+
+func (s *SQLStore) update(ctx context.Context, name string, key string, data []byte, version int64, expires int64) (int64, error) {
+	var (
+		query  string
+		result sql.Result
+	)
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	now := unixMillis(time.Now())
+	set := fmt.Sprintf("data = %s, version = version + 1, expires = COALESCE(%s, expires)", s.Dialect.Placeholder(1), s.Dialect.Placeholder(2))
+	if version == 0 {
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE hash = %s AND %s", table, set, s.Dialect.Placeholder(3), s.alive(4))
+		result, err = s.write(ctx, name, query, data, nullExpiry(expires), key, now)
+	} else {
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE hash = %s AND version = %s AND %s", table, set, s.Dialect.Placeholder(3), s.Dialect.Placeholder(4), s.alive(5))
+		result, err = s.write(ctx, name, query, data, nullExpiry(expires), key, version, now)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := s.Get(ctx, name, key); err != nil {
+			return 0, err
+		}
+		return 0, ErrConflict
+	}
+	if version != 0 {
+		return version + 1, nil
+	}
+	return s.version(ctx, name, key)
+}
+
+func (s *SQLStore) version(ctx context.Context, table string, key string) (int64, error) {
+	record, err := s.Get(ctx, table, key)
+	if err != nil {
+		return 0, err
+	}
+	return record.Version, nil
+}
+
+func (s *SQLStore) Upsert(ctx context.Context, name string, key string, data []byte) (int64, error) {
+	return s.upsert(ctx, name, key, data, 0)
+}
+
+func (s *SQLStore) upsert(ctx context.Context, name string, key string, data []byte, expires int64) (int64, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.purge(ctx, table, key); err != nil {
+		return 0, err
+	}
+	if _, err := s.write(ctx, name, fmt.Sprintf(s.Dialect.Upsert, table), key, data, nullExpiry(expires)); err != nil {
+		return 0, err
+	}
+	return s.version(ctx, name, key)
+}
+
+// WriteExpiring runs the insert, update or upsert named by op and sets the
+// record's expiry in the same statement.
+func (s *SQLStore) WriteExpiring(ctx context.Context, op string, name string, key string, data []byte, version int64, expires int64) (int64, error) {
+	switch op {
+	case "insert":
+		if err := s.insert(ctx, name, key, data, expires); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	case "update":
+		return s.update(ctx, name, key, data, version, expires)
+	case "upsert":
+		return s.upsert(ctx, name, key, data, expires)
+	}
+	return 0, fmt.Errorf("Unknown write: %s", op)
+}
+
+func (s *SQLStore) Delete(ctx context.Context, name string, key string, version int64) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		query := fmt.Sprintf("DELETE FROM %s WHERE hash = %s", table, s.Dialect.Placeholder(1))
+		_, err := s.conn().ExecContext(ctx, query, key)
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE hash = %s AND version = %s AND %s", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2), s.alive(3))
+	result, err := s.conn().ExecContext(ctx, query, key, version, unixMillis(time.Now()))
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := s.Get(ctx, name, key); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *SQLStore) Expire(ctx context.Context, name string, key string, expires int64) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	value := sql.NullInt64{Int64: expires, Valid: expires != 0}
+	query := fmt.Sprintf("UPDATE %s SET expires = %s WHERE hash = %s AND %s", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2), s.alive(3))
+	result, err := s.conn().ExecContext(ctx, query, value, key, unixMillis(time.Now()))
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		_, err := s.Get(ctx, name, key)
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStore) SoftDelete(ctx context.Context, name string, key string, version int64) error {
+	table, err := s.table(name)
+	if err != nil {
+		return err
+	}
+	now := unixMillis(time.Now())
+	query := fmt.Sprintf("UPDATE %s SET deleted = %s, version = version + 1 WHERE hash = %s AND %s", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2), s.alive(3))
+	args := []interface{}{now, key, now}
+	if version != 0 {
+		query += " AND version = " + s.Dialect.Placeholder(4)
+		args = append(args, version)
+	}
+	result, err := s.conn().ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := s.Get(ctx, name, key); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *SQLStore) Restore(ctx context.Context, name string, key string) (int64, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("UPDATE %s SET deleted = NULL, version = version + 1 WHERE hash = %s AND deleted IS NOT NULL AND (expires IS NULL OR expires > %s)", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2))
+	result, err := s.conn().ExecContext(ctx, query, key, unixMillis(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return 0, ErrNotFound
+	}
+	return s.version(ctx, name, key)
+}
+
+func (s *SQLStore) Tombstones(ctx context.Context, name string) ([]Record, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.conn().QueryContext(ctx, fmt.Sprintf("SELECT hash, data, version, expires, deleted FROM %s WHERE deleted IS NOT NULL ORDER BY hash ASC", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		var (
+			record  Record
+			expires sql.NullInt64
+		)
+		if err := rows.Scan(&record.Key, &record.Data, &record.Version, &expires, &record.Deleted); err != nil {
+			return nil, err
+		}
+		record.Expires = expires.Int64
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLStore) FindTombstones(ctx context.Context, index *Index, value interface{}) ([]Record, error) {
+	table, err := s.table(index.Table)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT hash, data, version, expires FROM %s WHERE %s AND deleted IS NOT NULL ORDER BY hash ASC", table, s.Dialect.Lookup(index, 1))
+	rows, err := s.conn().QueryContext(ctx, query, s.Dialect.Arg(value))
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+func (s *SQLStore) Reap(ctx context.Context, name string, before int64) (int, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE expires <= %s OR deleted < %s", table, s.Dialect.Placeholder(1), s.Dialect.Placeholder(2))
+	result, err := s.conn().ExecContext(ctx, query, unixMillis(time.Now()), before)
+	if err != nil {
+		return 0, err
+	}
+	reaped, err := result.RowsAffected()
+	return int(reaped), err
+}
+
+// CreateIndex indexes the field with an expression index, or on mysql with
+// an index on a generated column.
+func (s *SQLStore) CreateIndex(ctx context.Context, index *Index) error {
+	var count int
+	if _, err := s.table(index.Table); err != nil {
+		return err
+	}
+	if err := s.conn().QueryRowContext(ctx, s.Dialect.IndexExists, index.Table, index.Name()).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if s.Dialect.Generated != nil {
+		exists, err := s.columnExists(ctx, index.Table, index.Name())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := s.conn().ExecContext(ctx, s.Dialect.Generated(index)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := s.conn().ExecContext(ctx, s.Dialect.Index(index))
+	return err
+}
+
+func (s *SQLStore) Find(ctx context.Context, index *Index, value interface{}) ([]Record, error) {
+	table, err := s.table(index.Table)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT hash, data, version, expires FROM %s WHERE %s AND %s ORDER BY hash ASC", table, s.Dialect.Lookup(index, 1), s.alive(2))
+	rows, err := s.conn().QueryContext(ctx, query, s.Dialect.Arg(value), unixMillis(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+// sqlQuery collects the clauses and arguments of a query as it is built.
+type sqlQuery struct {
+	store *SQLStore
+	args  []interface{}
+}
+
+func (b *sqlQuery) expr(field string) string {
+	if field == "key" {
+		return "hash"
+	}
+	return b.store.Dialect.Field(field)
+}
+
+func (b *sqlQuery) param(field string, value interface{}) string {
+	if field == "key" {
+		b.args = append(b.args, value)
+		return b.store.Dialect.Placeholder(len(b.args))
+	}
+	b.args = append(b.args, b.store.Dialect.Arg(value))
+	return b.store.Dialect.Value(len(b.args))
+}
+
+// after builds the keyset condition selecting rows that sort after the
+// cursor.  Missing fields sort first in ascending order and last in
+// descending order, matching the ORDER BY clause.
+func (b *sqlQuery) after(q *Query, values []interface{}, key string) string {
+	terms := make([]string, 0, len(q.Sort)+1)
+	for i := 0; i <= len(q.Sort); i++ {
+		if i < len(q.Sort) && values[i] == nil && q.Sort[i].Desc {
+			continue
+		}
+		parts := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			if expr := b.expr(q.Sort[j].Field); values[j] == nil {
+				parts = append(parts, expr+" IS NULL")
+			} else {
+				parts = append(parts, fmt.Sprintf("%s = %s", expr, b.param(q.Sort[j].Field, values[j])))
+			}
+		}
+		if i == len(q.Sort) {
+			parts = append(parts, "hash > "+b.param("key", key))
+		} else if expr := b.expr(q.Sort[i].Field); values[i] == nil {
+			parts = append(parts, expr+" IS NOT NULL")
+		} else if q.Sort[i].Desc {
+			parts = append(parts, fmt.Sprintf("(%s < %s OR %s IS NULL)", expr, b.param(q.Sort[i].Field, values[i]), expr))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s > %s", expr, b.param(q.Sort[i].Field, values[i])))
+		}
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+// Query pushes filters, sorting and pagination down to the database using
+// the dialect's JSON functions.
+func (s *SQLStore) Query(ctx context.Context, name string, q *Query) ([]Record, error) {
+	table, err := s.table(name)
+	if err != nil {
+		return nil, err
+	}
+	b := &sqlQuery{store: s, args: []interface{}{unixMillis(time.Now())}}
+	where := make([]string, 0, len(q.Filters)+2)
+	where = append(where, s.alive(1))
+	ops := map[string]string{"eq": "=", "ne": "<>", "lt": "<", "lte": "<=", "gt": ">", "gte": ">="}
+	for _, filter := range q.Filters {
+		cond := fmt.Sprintf("%s %s %s", b.expr(filter.Field), ops[filter.Op], b.param(filter.Field, filter.Value))
+		if filter.Field != "key" {
+			cond = s.Dialect.Type(filter.Field, jsonType(filter.Value)) + " AND " + cond
+		}
+		where = append(where, cond)
+	}
+	values, key, err := q.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	if values != nil {
+		where = append(where, b.after(q, values, key))
+	}
+	query := fmt.Sprintf("SELECT hash, data, version, expires FROM %s WHERE %s", table, strings.Join(where, " AND "))
+	order := make([]string, 0, 2*len(q.Sort)+1)
+	for _, field := range q.Sort {
+		expr := b.expr(field.Field)
+		if field.Desc {
+			order = append(order, expr+" IS NULL ASC", expr+" DESC")
+		} else {
+			order = append(order, expr+" IS NULL DESC", expr+" ASC")
+		}
+	}
+	query += " ORDER BY " + strings.Join(append(order, "hash ASC"), ", ")
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	} else if q.Offset > 0 {
+		query += " LIMIT 9223372036854775807"
+	}
+	if q.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", q.Offset)
+	}
+	rows, err := s.conn().QueryContext(ctx, query, b.args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecords(rows)
+}
+
+func (s *SQLStore) Close() error {
+	if s.Tx != nil {
+		return errInTx
+	}
+	if s.Connection == nil {
+		return nil
+	}
+	return s.Connection.Close()
+}
@@ -459,6 +459,50 @@
     'use strict';
 
 
+    function patchNode(node, next) {
+        var x;
+
+        if (node.nodeType !== next.nodeType || node.nodeName !== next.nodeName ||
+                (node.nodeType === 1 && node.getAttribute('data-rt-href') !== next.getAttribute('data-rt-href'))) {
+            node.parentNode.replaceChild(next.cloneNode(true), node);
+            return;
+        }
+        if (node.nodeType !== 1) {
+            if (node.nodeValue !== next.nodeValue) {
+                node.nodeValue = next.nodeValue;
+            }
+            return;
+        }
+        for (x = node.attributes.length - 1; x >= 0; x -= 1) {
+            if (!next.hasAttribute(node.attributes[x].name)) {
+                node.removeAttribute(node.attributes[x].name);
+            }
+        }
+        for (x = 0; x < next.attributes.length; x += 1) {
+            if (node.getAttribute(next.attributes[x].name) !== next.attributes[x].value) {
+                node.setAttribute(next.attributes[x].name, next.attributes[x].value);
+            }
+        }
+        patchChildren(node, next);
+    }
+
+
+    function patchChildren(node, next) {
+        var x;
+
+        for (x = 0; x < next.childNodes.length; x += 1) {
+            if (x < node.childNodes.length) {
+                patchNode(node.childNodes[x], next.childNodes[x]);
+            } else {
+                node.appendChild(next.childNodes[x].cloneNode(true));
+            }
+        }
+        while (node.childNodes.length > next.childNodes.length) {
+            node.removeChild(node.lastChild);
+        }
+    }
+
+
     function RTGo() {
         var protocol = global.location.protocol === 'http:'
                 ? 'ws://'
@@ -474,6 +518,7 @@
         this.socket.on('close', this.onclose.bind(this));
         this.socket.on('error', this.onerror.bind(this));
         this.socket.on('response', this.onresponse.bind(this));
+        this.socket.on('account', this.onaccount.bind(this));
         global.addEventListener('hashchange', this.onhashchange.bind(this), false);
     }
 
@@ -503,7 +548,10 @@
         if (hrefs && hrefs.length) {
             for (x = 0; x < hrefs.length; x += 1) {
                 node = hrefs[x];
-                node.addEventListener('click', func(node.getAttribute('data-rt-href')), false);
+                if (!node.rtHref) {
+                    node.rtHref = true;
+                    node.addEventListener('click', func(node.getAttribute('data-rt-href')), false);
+                }
             }
         }
     };
@@ -535,8 +583,19 @@
         var payload = JSON.parse(wsrooms.getStringFromCodes(data)),
             view = payload.view,
             template = payload.template,
-            controllers = payload.controllers && payload.controllers.split(',');
-
+            controllers = payload.controllers && payload.controllers.split(','),
+            next;
+
+        if (payload.update) {
+            if (this.view && template) {
+                next = document.createElement(this.view.nodeName);
+                next.innerHTML = template;
+                patchChildren(this.view, next);
+            }
+            this.assignHrefs();
+            this.socket.emit('update', view);
+            return;
+        }
         if (this.view && template) {
             this.view.innerHTML = template;
         }
@@ -553,6 +612,16 @@
     };
 
 
+    RTGo.prototype.onaccount = function onaccount(data) {
+        var payload = JSON.parse(wsrooms.getStringFromCodes(data));
+
+        if (payload.status === 'ok' && payload.cookie) {
+            document.cookie = payload.cookie;
+        }
+        this.socket.emit(payload.action, payload);
+    };
+
+
     RTGo.prototype.onhashchange = function onhashchange() {
         var curhash = global.location.hash;
 
@@ -593,9 +662,108 @@ rtgo.controllers.login = (function login(global) {
 
 
     var formContainer = document.querySelector('.form-container'),
-        loginForm = document.querySelector('.form[name="login"]'),
-        registerForm = document.querySelector('.form[name="register"]'),
-        submit = document.querySelector('.form-button');
+        forms = document.querySelectorAll('.form'),
+        tokenInput = document.querySelector('.form-token'),
+        submits = document.querySelectorAll('.form-button'),
+        links = document.querySelectorAll('.form-link'),
+        fields = {
+            login: ['username', 'password'],
+            register: ['username', 'email', 'password'],
+            forgot: ['username'],
+            reset: ['token', 'password']
+        },
+        reset = /[?&]reset=([^&]+)/.exec(global.location.search),
+        rules = {
+            username_min: 3,
+            username_max: 32,
+            username_pattern: '^[A-Za-z0-9_]+$',
+            email_pattern: '^[A-Za-z0-9._%+\\-]+@[A-Za-z0-9.\\-]+\\.[A-Za-z]{2,}$',
+            password_min: 8,
+            password_classes: 2,
+            hashed_passwords: false
+        },
+        x;
+
+
+    function loadRules() {
+        var xhr = new XMLHttpRequest();
+
+        xhr.onloadend = function () {
+            if (xhr.readyState === 4 && xhr.status === 200) {
+                rules = JSON.parse(xhr.responseText);
+            }
+        };
+        xhr.open('get', '/validation', true);
+        xhr.send();
+    }
+    loadRules();
+
+
+    function showErrors(form, errors) {
+        var inputs = document.querySelectorAll('form[name="' + form + '"] .form-input'),
+            container,
+            message,
+            input,
+            i;
+
+        errors = errors || {};
+        for (i = 0; i < inputs.length; i += 1) {
+            input = inputs[i];
+            container = input.parentNode;
+            message = container.querySelector('.form-error');
+            if (message) {
+                container.removeChild(message);
+            }
+            container.classList.remove('fail');
+            if (errors.hasOwnProperty(input.name)) {
+                message = document.createElement('span');
+                message.className = 'form-error';
+                message.textContent = errors[input.name];
+                container.appendChild(message);
+                container.classList.add('fail');
+            }
+        }
+        if (errors.hasOwnProperty('token') && form === 'reset') {
+            console.log('Reset failed: ' + errors.token);
+        }
+    }
+
+
+    function checkPassword(val) {
+        var classes = [/[a-z]/, /[A-Z]/, /[0-9]/, /[^a-zA-Z0-9]/].filter(function (regx) {
+            return regx.test(val);
+        }).length;
+
+        if (val.length < rules.password_min) {
+            return 'Password must be at least ' + rules.password_min + ' characters.';
+        }
+        if (classes < rules.password_classes) {
+            return 'Password must mix at least ' + rules.password_classes + ' of lowercase, uppercase, digits and symbols.';
+        }
+        return '';
+    }
+
+
+    function checkValue(form, name, val) {
+        if (!val) {
+            return 'This field is required.';
+        }
+        if (name === 'username' && form === 'register') {
+            if (val.length < rules.username_min || val.length > rules.username_max) {
+                return 'Username must be between ' + rules.username_min + ' and ' + rules.username_max + ' characters.';
+            }
+            if (!(new RegExp(rules.username_pattern)).test(val)) {
+                return 'Username contains invalid characters.';
+            }
+        }
+        if (name === 'email' && !(new RegExp(rules.email_pattern)).test(val)) {
+            return 'Email is not a valid address.';
+        }
+        if (name === 'password' && (form === 'register' || form === 'reset')) {
+            return checkPassword(val);
+        }
+        return '';
+    }
 
 
     function toggleFadeClass() {
@@ -609,22 +777,62 @@ rtgo.controllers.login = (function login(global) {
     }
 
 
+    function showForm(name) {
+        var form,
+            i;
+
+        for (i = 0; i < forms.length; i += 1) {
+            form = forms[i];
+            if (form.getAttribute('name') === name) {
+                form.classList.remove('hide');
+            } else {
+                form.classList.add('hide');
+            }
+        }
+        toggleFadeClass();
+    }
+
+
     function sendForm(values) {
         var xhr = new XMLHttpRequest(),
-            fd = new FormData();
+            fd = new FormData(),
+            names = fields[values.type] || [],
+            i;
 
-        if (!values.username || !values.password || (values.type === 'register' && !values.email)) {
-            return;
+        if (tokenInput && values.type === 'reset') {
+            values.token = tokenInput.value;
         }
-        fd.append('username', values.username);
-        fd.append('password', sjcl.codec.hex.fromBits(sjcl.hash.sha256.hash(values.password)));
-        if (values.type === 'register') {
-            fd.append('email', values.email);
+        for (i = 0; i < names.length; i += 1) {
+            if (!values[names[i]]) {
+                return;
+            }
+            fd.append(names[i], names[i] === 'password' && rules.hashed_passwords
+                ? sjcl.codec.hex.fromBits(sjcl.hash.sha256.hash(values[names[i]]))
+                : values[names[i]]);
         }
         xhr.onloadend = function () {
-            if (xhr.readyState === 4 && (xhr.status >= 200 && xhr.status < 300)) {
+            var response;
+
+            if (xhr.readyState !== 4) {
+                return;
+            }
+            if (xhr.status >= 200 && xhr.status < 300) {
                 console.log('Login success: ' + xhr.response);
+                showErrors(values.type, null);
+                if (values.type === 'reset' && global.history && global.history.replaceState) {
+                    global.history.replaceState(null, '', global.location.pathname + global.location.hash);
+                }
+                return;
+            }
+            try {
+                response = JSON.parse(xhr.responseText);
+            } catch (err) {
+                response = {
+                    error: xhr.statusText
+                };
             }
+            showErrors(values.type, response.fields);
+            console.log('Login failed: ' + response.error);
         };
         xhr.onerror = function (e) {
             console.log('Login failed: ' + e);
@@ -635,41 +843,44 @@ rtgo.controllers.login = (function login(global) {
 
 
     function checkFields(e) {
-        var wordregx = /^\w+$/,
-            emailregx = /^[\w.%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,4}$/,
-            form = e.target.getAttribute('data-form'),
+        var form = e.target.getAttribute('data-form'),
             inputs = document.querySelectorAll('form[name="' + form + '"] .form-input'),
             values = {
                 type: form
             },
+            errors = {},
+            failed = false,
             input,
-            name,
-            val,
+            error,
             x;
 
-        function failed() {
-            input.parentNode.classList.add('fail');
-        }
-
         for (x = 0; x < inputs.length; x += 1) {
             input = inputs[x];
-            name = input.name;
-            val = input.value;
-            if (((name === 'username' || name === 'password') && !wordregx.test(val)) || (name === 'email' && !emailregx.test(val))) {
-                val = '';
-            }
-            if (!val) {
-                input.value = '';
-                input.parentNode.classList.remove('fail');
-                setTimeout(failed, 200);
+            error = checkValue(form, input.name, input.value);
+            if (error) {
+                errors[input.name] = error;
+                failed = true;
             } else {
-                values[name] = val;
-                input.value = '';
+                values[input.name] = input.value;
             }
+            input.value = '';
+        }
+        showErrors(form, errors);
+        if (!failed) {
+            sendForm(values);
         }
-        sendForm(values);
     }
-    submit.addEventListener('click', checkFields, false);
+    for (x = 0; x < submits.length; x += 1) {
+        submits[x].addEventListener('click', checkFields, false);
+    }
+
+
+    function followLink(e) {
+        showForm(e.target.getAttribute('data-show'));
+    }
+    for (x = 0; x < links.length; x += 1) {
+        links[x].addEventListener('click', followLink, false);
+    }
 
 
     function addGlow(e) {
@@ -688,16 +899,21 @@ rtgo.controllers.login = (function login(global) {
     document.querySelector('.form-input').addEventListener('blur', removeGlow, false);
 
 
+    if (reset && tokenInput) {
+        tokenInput.value = decodeURIComponent(reset[1]);
+        showForm('reset');
+    }
+
+
     return {
         showRegister: function showRegister() {
-            loginForm.classList.add('hide');
-            registerForm.classList.remove('hide');
-            toggleFadeClass();
+            showForm('register');
         },
         showLogin: function showLogin() {
-            registerForm.classList.add('hide');
-            loginForm.classList.remove('hide');
-            toggleFadeClass();
+            showForm('login');
+        },
+        showForgot: function showForgot() {
+            showForm('forgot');
         },
         hideForms: function hideForms() {
             formContainer.classList.add('fade-up');
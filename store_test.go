@@ -0,0 +1,351 @@
+//    Title: store_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testStoreParams opens the drivers that need no server.  Drivers without an
+// entry are skipped.
+var testStoreParams = map[string]func(dir string) map[string]string{
+	"memory": func(dir string) map[string]string {
+		return map[string]string{}
+	},
+	"file": func(dir string) map[string]string {
+		return map[string]string{"file": filepath.Join(dir, "rtgo.db"), "sync": "false"}
+	},
+	"sqlite3": func(dir string) map[string]string {
+		return map[string]string{"file": filepath.Join(dir, "rtgo.sqlite")}
+	},
+}
+
+// storeChecks is the conformance suite every driver must pass.  Each check
+// gets a table of its own.
+var storeChecks = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, store Store, table string)
+}{
+	{"InsertGet", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":1}`, 1)
+	}},
+	{"InsertExisting", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		expectErr(t, store.Insert(ctx, table, "a", []byte(`{"n":2}`)), ErrExists)
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":1}`, 1)
+	}},
+	{"GetMissing", func(t *testing.T, ctx context.Context, store Store, table string) {
+		_, err := store.Get(ctx, table, "missing")
+		expectErr(t, err, ErrNotFound)
+	}},
+	{"All", func(t *testing.T, ctx context.Context, store Store, table string) {
+		records, err := store.All(ctx, table)
+		mustStore(t, err)
+		if len(records) != 0 {
+			t.Fatalf("empty table has %d records", len(records))
+		}
+		for _, key := range []string{"c", "a", "b"} {
+			mustStore(t, store.Insert(ctx, table, key, []byte(`{"key":"`+key+`"}`)))
+		}
+		if _, err := store.Update(ctx, table, "b", []byte(`{"key":"b","n":2}`), 1); err != nil {
+			t.Fatal(err)
+		}
+		records, err = store.All(ctx, table)
+		mustStore(t, err)
+		sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+		if len(records) != 3 {
+			t.Fatalf("got %d records, want 3", len(records))
+		}
+		expectRecord(t, &records[0], "a", `{"key":"a"}`, 1)
+		expectRecord(t, &records[1], "b", `{"key":"b","n":2}`, 2)
+		expectRecord(t, &records[2], "c", `{"key":"c"}`, 1)
+	}},
+	{"UpdateBumpsVersion", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		for want := int64(2); want <= 4; want++ {
+			version, err := store.Update(ctx, table, "a", []byte(`{"n":2}`), want-1)
+			mustStore(t, err)
+			if version != want {
+				t.Fatalf("got version %d, want %d", version, want)
+			}
+		}
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":2}`, 4)
+	}},
+	{"UpdateConflict", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		_, err := store.Update(ctx, table, "a", []byte(`{"n":2}`), 1)
+		mustStore(t, err)
+		_, err = store.Update(ctx, table, "a", []byte(`{"n":3}`), 1)
+		expectErr(t, err, ErrConflict)
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":2}`, 2)
+	}},
+	{"UpdateUnchecked", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		version, err := store.Update(ctx, table, "a", []byte(`{"n":2}`), 0)
+		mustStore(t, err)
+		if version != 2 {
+			t.Fatalf("got version %d, want 2", version)
+		}
+	}},
+	{"UpdateMissing", func(t *testing.T, ctx context.Context, store Store, table string) {
+		_, err := store.Update(ctx, table, "missing", []byte(`{"n":1}`), 0)
+		expectErr(t, err, ErrNotFound)
+	}},
+	{"Upsert", func(t *testing.T, ctx context.Context, store Store, table string) {
+		version, err := store.Upsert(ctx, table, "a", []byte(`{"n":1}`))
+		mustStore(t, err)
+		if version != 1 {
+			t.Fatalf("got version %d for a new object, want 1", version)
+		}
+		version, err = store.Upsert(ctx, table, "a", []byte(`{"n":2}`))
+		mustStore(t, err)
+		if version != 2 {
+			t.Fatalf("got version %d for a replaced object, want 2", version)
+		}
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":2}`, 2)
+	}},
+	{"Delete", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		mustStore(t, store.Delete(ctx, table, "a", 1))
+		_, err := store.Get(ctx, table, "a")
+		expectErr(t, err, ErrNotFound)
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":2}`)))
+		record, err := store.Get(ctx, table, "a")
+		mustStore(t, err)
+		expectRecord(t, record, "a", `{"n":2}`, 1)
+	}},
+	{"DeleteConflict", func(t *testing.T, ctx context.Context, store Store, table string) {
+		mustStore(t, store.Insert(ctx, table, "a", []byte(`{"n":1}`)))
+		expectErr(t, store.Delete(ctx, table, "a", 2), ErrConflict)
+		mustStore(t, store.Delete(ctx, table, "a", 0))
+	}},
+	{"DeleteMissing", func(t *testing.T, ctx context.Context, store Store, table string) {
+		expectErr(t, store.Delete(ctx, table, "missing", 1), ErrNotFound)
+		mustStore(t, store.Delete(ctx, table, "missing", 0))
+	}},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, driver := range Drivers() {
+		driver := driver
+		t.Run(driver, func(t *testing.T) {
+			params, ok := testStoreParams[driver]
+			if !ok {
+				t.Skipf("driver %s needs a server", driver)
+			}
+			ctx := context.Background()
+			store, err := NewStore(driver)
+			mustStore(t, err)
+			mustStore(t, store.Open(ctx, params(t.TempDir())))
+			defer store.Close()
+			for _, check := range storeChecks {
+				check := check
+				t.Run(check.name, func(t *testing.T) {
+					table := "conformance_" + check.name
+					mustStore(t, store.CreateTable(ctx, table))
+					check.run(t, ctx, store, table)
+				})
+			}
+		})
+	}
+}
+
+func mustStore(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectErr(t *testing.T, err error, want error) {
+	t.Helper()
+	if err != want {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func expectRecord(t *testing.T, record *Record, key string, data string, version int64) {
+	t.Helper()
+	var got, want interface{}
+	if err := json.Unmarshal(record.Data, &got); err != nil {
+		t.Fatalf("record %s holds invalid JSON %q: %s", record.Key, record.Data, err)
+	}
+	json.Unmarshal([]byte(data), &want)
+	if record.Key != key || record.Version != version || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got record %s %s version %d, want %s %s version %d", record.Key, record.Data, record.Version, key, data, version)
+	}
+}
+
+// TestUniqueAfterSoftDelete checks that a soft deleted object keeps its
+// unique values on every driver, so it can be restored without a duplicate.
+func TestUniqueAfterSoftDelete(t *testing.T) {
+	for driver, params := range testStoreParams {
+		driver, params := driver, params
+		t.Run(driver, func(t *testing.T) {
+			ctx := context.Background()
+			settings := params(t.TempDir())
+			settings["indexes"] = "people.email unique"
+			db, err := NewApp().NewDatabase(driver, settings)
+			mustStore(t, err)
+			defer db.Close()
+			mustStore(t, db.SetTablePolicy("people", &TablePolicy{SoftDelete: true, TTL: time.Hour}))
+			mustStore(t, db.InsertObj(ctx, "people", "a", map[string]string{"email": "a@example.com"}))
+			mustStore(t, db.DeleteObj(ctx, "people", "a"))
+			err = db.InsertObj(ctx, "people", "b", map[string]string{"email": "a@example.com"})
+			if unique, ok := err.(*UniqueError); !ok || unique.Field != "email" {
+				t.Fatalf("got error %v, want a UniqueError for email", err)
+			}
+			_, err = db.Restore(ctx, "people", "a")
+			mustStore(t, err)
+			record, err := db.Store.Get(ctx, "people", "a")
+			mustStore(t, err)
+			if record.Expires == 0 {
+				t.Fatal("the TTL was not set by the write")
+			}
+		})
+	}
+}
+
+// TestCreateIndexWhileWriting checks that indexes can be declared while
+// writers are checking the unique ones.
+func TestCreateIndexWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewApp().NewDatabase("memory", map[string]string{"indexes": "people.email unique"})
+	mustStore(t, err)
+	defer db.Close()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := db.CreateIndex(ctx, &Index{Table: "people", Field: "name" + strconv.Itoa(i)}); err != nil {
+				t.Error(err)
+			}
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		mustStore(t, db.InsertObj(ctx, "people", strconv.Itoa(i), map[string]string{"email": strconv.Itoa(i) + "@example.com"}))
+	}
+	<-done
+	if got := len(db.indexes()); got != 101 {
+		t.Fatalf("%d indexes, want 101", got)
+	}
+}
+
+// TestFindTombstones checks that every driver looks up soft deleted records
+// by an indexed value and leaves out the live ones and the other values.
+func TestFindTombstones(t *testing.T) {
+	for driver, params := range testStoreParams {
+		driver, params := driver, params
+		t.Run(driver, func(t *testing.T) {
+			ctx := context.Background()
+			settings := params(t.TempDir())
+			settings["indexes"] = "people.email unique"
+			db, err := NewApp().NewDatabase(driver, settings)
+			mustStore(t, err)
+			defer db.Close()
+			mustStore(t, db.SetTablePolicy("people", &TablePolicy{SoftDelete: true}))
+			for _, key := range []string{"a", "b", "c"} {
+				mustStore(t, db.InsertObj(ctx, "people", key, map[string]string{"email": key + "@example.com"}))
+			}
+			mustStore(t, db.DeleteObj(ctx, "people", "a"))
+			mustStore(t, db.DeleteObj(ctx, "people", "b"))
+			index := db.index("people", "email")
+			tests := []struct {
+				email string
+				want  []string
+			}{
+				{"a@example.com", []string{"a"}},
+				{"b@example.com", []string{"b"}},
+				{"c@example.com", nil},
+				{"d@example.com", nil},
+			}
+			for _, test := range tests {
+				records, err := db.findTombstones(ctx, index, test.email)
+				mustStore(t, err)
+				keys := make([]string, 0)
+				for _, record := range records {
+					keys = append(keys, record.Key)
+				}
+				if len(keys) != len(test.want) || (len(keys) > 0 && !reflect.DeepEqual(keys, test.want)) {
+					t.Errorf("tombstones for %s: got %v, want %v", test.email, keys, test.want)
+				}
+			}
+		})
+	}
+}
+
+// TestFileStoreCompaction checks that a write is kept even when the
+// compaction it sets off fails, and that the log survives a reopen after the
+// compaction succeeds.
+func TestFileStoreCompaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rtgo.db")
+	params := map[string]string{"file": path, "sync": "false", "compact_after": "2"}
+	store, err := NewStore("file")
+	mustStore(t, err)
+	mustStore(t, store.Open(ctx, params))
+	mustStore(t, store.CreateTable(ctx, "items"))
+	mustStore(t, store.Insert(ctx, "items", "a", []byte(`{"n":0}`)))
+	// A directory in the way of the temporary file fails every compaction.
+	mustStore(t, os.Mkdir(path+".compact", 0700))
+	tests := []struct {
+		blocked bool
+		n       int
+	}{
+		{true, 1},
+		{true, 2},
+		{true, 3},
+		{false, 4},
+		{false, 5},
+	}
+	for _, test := range tests {
+		if !test.blocked {
+			os.Remove(path + ".compact")
+		}
+		data := []byte(`{"n":` + strconv.Itoa(test.n) + `}`)
+		if _, err := store.Upsert(ctx, "items", "a", data); err != nil {
+			t.Fatalf("write %d failed: %s", test.n, err)
+		}
+	}
+	mustStore(t, store.Close())
+	store, err = NewStore("file")
+	mustStore(t, err)
+	mustStore(t, store.Open(ctx, params))
+	defer store.Close()
+	record, err := store.Get(ctx, "items", "a")
+	mustStore(t, err)
+	expectRecord(t, record, "a", `{"n":5}`, 6)
+}
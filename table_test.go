@@ -0,0 +1,235 @@
+//    Title: table_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// injectedTables are table names an attacker might put in a request path or
+// a route capture.
+var injectedTables = []string{
+	"users;DROP TABLE victim",
+	"users; DROP TABLE victim; --",
+	`users"; DROP TABLE victim; --`,
+	"users`; DROP TABLE victim; --",
+	"users'; DROP TABLE victim; --",
+	`"users"`,
+	"main.users",
+	"public.users",
+	"victim.users",
+	"../users",
+	"users--",
+	"users victim",
+	"1users",
+	"",
+}
+
+// recordingStore passes calls on to its Store and records them, so a test
+// can tell that nothing reached the driver.
+type recordingStore struct {
+	Store
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *recordingStore) record(call string, table string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call+" "+table)
+}
+
+func (s *recordingStore) Get(ctx context.Context, table string, key string) (*Record, error) {
+	s.record("Get", table)
+	return s.Store.Get(ctx, table, key)
+}
+
+func (s *recordingStore) All(ctx context.Context, table string) ([]Record, error) {
+	s.record("All", table)
+	return s.Store.All(ctx, table)
+}
+
+func (s *recordingStore) Insert(ctx context.Context, table string, key string, data []byte) error {
+	s.record("Insert", table)
+	return s.Store.Insert(ctx, table, key, data)
+}
+
+func (s *recordingStore) Update(ctx context.Context, table string, key string, data []byte, version int64) (int64, error) {
+	s.record("Update", table)
+	return s.Store.Update(ctx, table, key, data, version)
+}
+
+func (s *recordingStore) Upsert(ctx context.Context, table string, key string, data []byte) (int64, error) {
+	s.record("Upsert", table)
+	return s.Store.Upsert(ctx, table, key, data)
+}
+
+func (s *recordingStore) Delete(ctx context.Context, table string, key string, version int64) error {
+	s.record("Delete", table)
+	return s.Store.Delete(ctx, table, key, version)
+}
+
+func (s *recordingStore) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// injectionApp opens a sqlite database holding a victim table with one object
+// and puts a recordingStore in front of it.
+func injectionApp(t *testing.T) (*App, *recordingStore) {
+	t.Helper()
+	ctx := context.Background()
+	a := NewApp()
+	db, err := a.NewDatabase("sqlite3", map[string]string{"file": filepath.Join(t.TempDir(), "rtgo.sqlite")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.CreateTable(ctx, "victim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertObj(ctx, "victim", "v", map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingStore{Store: db.Store}
+	db.Store = recorder
+	return a, recorder
+}
+
+// expectUntouched checks that no call reached the store and that the victim
+// table still holds its object.
+func expectUntouched(t *testing.T, recorder *recordingStore) {
+	t.Helper()
+	if calls := recorder.Calls(); len(calls) != 0 {
+		t.Fatalf("calls reached the store: %v", calls)
+	}
+	if _, err := recorder.Store.Get(context.Background(), "victim", "v"); err != nil {
+		t.Fatalf("victim table was changed: %s", err)
+	}
+}
+
+func expectTableError(t *testing.T, name string, err error) {
+	t.Helper()
+	var tableErr *TableError
+	if !errors.As(err, &tableErr) {
+		t.Fatalf("table %q: got error %v, want a *TableError", name, err)
+	}
+	if tableErr.Table != name {
+		t.Fatalf("table %q: the error names %q", name, tableErr.Table)
+	}
+}
+
+func TestValidTableRejectsInjection(t *testing.T) {
+	for _, name := range injectedTables {
+		if ValidTable(name) {
+			t.Errorf("ValidTable(%q) is true", name)
+		}
+	}
+	for _, name := range []string{"users", "_users", "Users2", "user_posts"} {
+		if !ValidTable(name) {
+			t.Errorf("ValidTable(%q) is false", name)
+		}
+	}
+}
+
+// TestSQLStoreRejectsInjection calls the sqlite driver directly, past the
+// checks of Database, so the driver's own quoting is what is tested.
+func TestSQLStoreRejectsInjection(t *testing.T) {
+	ctx := context.Background()
+	store := &SQLStore{Dialect: Sqlite3}
+	if err := store.Open(ctx, map[string]string{"file": filepath.Join(t.TempDir(), "rtgo.sqlite")}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.CreateTable(ctx, "victim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(ctx, "victim", "v", []byte(`{"n":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range injectedTables {
+		_, err := store.table(name)
+		expectTableError(t, name, err)
+		expectTableError(t, name, store.CreateTable(ctx, name))
+		_, err = store.Get(ctx, name, "v")
+		expectTableError(t, name, err)
+		_, err = store.All(ctx, name)
+		expectTableError(t, name, err)
+		expectTableError(t, name, store.Insert(ctx, name, "k", []byte(`{}`)))
+		_, err = store.Upsert(ctx, name, "k", []byte(`{}`))
+		expectTableError(t, name, err)
+		expectTableError(t, name, store.Delete(ctx, name, "v", 0))
+	}
+	if _, err := store.Get(ctx, "victim", "v"); err != nil {
+		t.Fatalf("victim table was changed: %s", err)
+	}
+}
+
+func TestObjectsRejectInjection(t *testing.T) {
+	ctx := context.Background()
+	a, recorder := injectionApp(t)
+	// sqlite_master is a plain identifier but was never created, so it is
+	// refused as unknown rather than invalid.
+	for _, name := range append(injectedTables, "sqlite_master") {
+		_, err := a.DB.GetObj(ctx, name, "v")
+		expectTableError(t, name, err)
+		expectTableError(t, name, a.DB.InsertObj(ctx, name, "k", map[string]int{"n": 1}))
+		_, err = a.DB.GetAllObjs(ctx, name)
+		expectTableError(t, name, err)
+		_, _, err = a.DB.Query(ctx, name, &Query{})
+		expectTableError(t, name, err)
+	}
+	expectUntouched(t, recorder)
+}
+
+func TestRouteCapturesRejectInjection(t *testing.T) {
+	a, recorder := injectionApp(t)
+	a.Routes = map[string]map[string]string{
+		"^/list/(.*)$":         {"template": "list", "table": "$1"},
+		"^/show/([^/]*)/(.*)$": {"template": "show", "table": "$1", "key": "$2"},
+	}
+	a.Templates = template.Must(template.New("list").Parse(`{{len .}}`))
+	template.Must(a.Templates.New("show").Parse(`{{len .}}`))
+	c := &Conn{Application: a, Id: "test"}
+	for _, name := range append(injectedTables, "sqlite_master") {
+		if name == "" {
+			continue
+		}
+		paths := []string{"/list/" + name}
+		if !strings.Contains(name, "/") {
+			paths = append(paths, "/show/"+name+"/v")
+		}
+		for _, path := range paths {
+			route := a.FindRoute(path)
+			if route["table"] != name {
+				t.Fatalf("%s: captured table %q, want %q", path, route["table"], name)
+			}
+			data, _ := c.renderView(path)
+			if data == nil || data["template"] != "0" {
+				t.Fatalf("%s: rendered %v, want an empty collection", path, data)
+			}
+		}
+	}
+	expectUntouched(t, recorder)
+}
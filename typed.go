@@ -0,0 +1,106 @@
+//    Title: typed.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeError reports a stored record that does not decode into the type it
+// was requested as.
+type DecodeError struct {
+	Table string
+	Key   string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Cannot decode %s/%s: %s", e.Table, e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decode[T any](table string, record *Record) (T, error) {
+	var value T
+	if err := json.Unmarshal(record.Data, &value); err != nil {
+		return value, &DecodeError{Table: table, Key: record.Key, Err: err}
+	}
+	return value, nil
+}
+
+func decodeAll[T any](table string, records []Record) ([]T, error) {
+	values := make([]T, 0, len(records))
+	for i := range records {
+		value, err := decode[T](table, &records[i])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Get decodes the object stored under key into a T.
+func Get[T any](ctx context.Context, db *Database, table string, key string) (T, error) {
+	value, _, err := GetVersion[T](ctx, db, table, key)
+	return value, err
+}
+
+func GetVersion[T any](ctx context.Context, db *Database, table string, key string) (T, int64, error) {
+	var value T
+	if err := db.checkTable(table); err != nil {
+		return value, 0, err
+	}
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	record, err := db.get(ctx, table, key)
+	if err != nil {
+		return value, 0, err
+	}
+	value, err = decode[T](table, record)
+	return value, record.Version, err
+}
+
+// List decodes the objects selected by q, or every object of table if q is
+// nil.  The cursor for the next page is returned as with Database.Query.
+func List[T any](ctx context.Context, db *Database, table string, q *Query) ([]T, string, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	records, next, err := db.QueryRecords(ctx, table, q)
+	if err != nil {
+		return nil, "", err
+	}
+	values, err := decodeAll[T](table, records)
+	if err != nil {
+		return nil, "", err
+	}
+	return values, next, nil
+}
+
+// Find decodes the objects of table whose field equals value.
+func Find[T any](ctx context.Context, db *Database, table string, field string, value interface{}) ([]T, error) {
+	records, err := db.FindRecords(ctx, table, field, value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAll[T](table, records)
+}
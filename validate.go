@@ -0,0 +1,176 @@
+//    Title: validate.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"unicode"
+)
+
+var hashedPassword = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type Rules struct {
+	UsernameMin     int    `json:"username_min"`
+	UsernameMax     int    `json:"username_max"`
+	UsernamePattern string `json:"username_pattern"`
+	EmailPattern    string `json:"email_pattern"`
+	PasswordMin     int    `json:"password_min"`
+	PasswordClasses int    `json:"password_classes"`
+	HashedPasswords bool   `json:"hashed_passwords"`
+	username        *regexp.Regexp
+	email           *regexp.Regexp
+}
+
+type FieldErrors map[string]string
+
+type ErrorResponse struct {
+	Error  string      `json:"error"`
+	Fields FieldErrors `json:"fields,omitempty"`
+}
+
+func NewRules(params map[string]string) (*Rules, error) {
+	var err error
+	rules := &Rules{
+		UsernameMin:     3,
+		UsernameMax:     32,
+		UsernamePattern: "^[A-Za-z0-9_]+$",
+		EmailPattern:    "^[A-Za-z0-9._%+\\-]+@[A-Za-z0-9.\\-]+\\.[A-Za-z]{2,}$",
+		PasswordMin:     8,
+		PasswordClasses: 2,
+	}
+	ints := map[string]*int{
+		"username_min":     &rules.UsernameMin,
+		"username_max":     &rules.UsernameMax,
+		"password_min":     &rules.PasswordMin,
+		"password_classes": &rules.PasswordClasses,
+	}
+	for key, dest := range ints {
+		if val, ok := params[key]; ok {
+			if *dest, err = strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("Invalid validation value for %s: %s", key, val)
+			}
+		}
+	}
+	if val, ok := params["username_pattern"]; ok {
+		rules.UsernamePattern = val
+	}
+	if val, ok := params["email_pattern"]; ok {
+		rules.EmailPattern = val
+	}
+	if val, ok := params["hashed_passwords"]; ok {
+		rules.HashedPasswords = val == "true"
+	}
+	if rules.username, err = regexp.Compile(rules.UsernamePattern); err != nil {
+		return nil, err
+	}
+	if rules.email, err = regexp.Compile(rules.EmailPattern); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r *Rules) CheckUsername(errs FieldErrors, username string) {
+	switch {
+	case username == "":
+		errs["username"] = "Username is required."
+	case len(username) < r.UsernameMin || len(username) > r.UsernameMax:
+		errs["username"] = fmt.Sprintf("Username must be between %d and %d characters.", r.UsernameMin, r.UsernameMax)
+	case !r.username.MatchString(username):
+		errs["username"] = "Username contains invalid characters."
+	}
+}
+
+func (r *Rules) CheckEmail(errs FieldErrors, field string, email string) {
+	switch {
+	case email == "":
+		errs[field] = "Email is required."
+	case !r.email.MatchString(email):
+		errs[field] = "Email is not a valid address."
+	}
+}
+
+// CheckPassword enforces the length and strength rules.  With
+// HashedPasswords, an explicit opt-in, clients send a SHA-256 digest instead
+// of the password, so the rules can only be enforced by the client and the
+// server just checks that it got a digest.
+func (r *Rules) CheckPassword(errs FieldErrors, field string, password string) {
+	if password == "" {
+		errs[field] = "Password is required."
+		return
+	}
+	if r.HashedPasswords {
+		if !hashedPassword.MatchString(password) {
+			errs[field] = "Password must be hashed by the client."
+		}
+		return
+	}
+	var lower, upper, digit, other bool
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			lower = true
+		case unicode.IsUpper(char):
+			upper = true
+		case unicode.IsDigit(char):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			classes++
+		}
+	}
+	if len([]rune(password)) < r.PasswordMin {
+		errs[field] = fmt.Sprintf("Password must be at least %d characters.", r.PasswordMin)
+	} else if classes < r.PasswordClasses {
+		errs[field] = fmt.Sprintf("Password must mix at least %d of lowercase, uppercase, digits and symbols.", r.PasswordClasses)
+	}
+}
+
+func WriteError(w http.ResponseWriter, status int, message string, fields FieldErrors) {
+	body, err := json.Marshal(&ErrorResponse{Error: message, Fields: fields})
+	if err != nil {
+		log.Println("error encoding json: ", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (a *App) RulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, 405, "Method not allowed", nil)
+		return
+	}
+	body, err := json.Marshal(a.Rules)
+	if err != nil {
+		WriteError(w, 500, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,111 @@
+//    Title: validate_test.go
+//    Author: Jon Cody
+//
+//    This program is free software: you can redistribute it and/or modify
+//    it under the terms of the GNU General Public License as published by
+//    the Free Software Foundation, either version 3 of the License, or
+//    (at your option) any later version.
+//
+//    This program is distributed in the hope that it will be useful,
+//    but WITHOUT ANY WARRANTY; without even the implied warranty of
+//    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//    GNU General Public License for more details.
+//
+//    You should have received a copy of the GNU General Public License
+//    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rtgo
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		name   string
+		params map[string]string
+		check  func(r *Rules, errs FieldErrors)
+		want   string
+	}{
+		{"username", nil, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, "jon_1") }, ""},
+		{"username missing", nil, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, "") }, "Username is required."},
+		{"username short", nil, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, "jo") }, "Username must be between 3 and 32 characters."},
+		{"username long", nil, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, strings.Repeat("j", 33)) }, "Username must be between 3 and 32 characters."},
+		{"username characters", nil, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, "jon doe") }, "Username contains invalid characters."},
+		{"username pattern", map[string]string{"username_pattern": "^[a-z]+$"}, func(r *Rules, errs FieldErrors) { r.CheckUsername(errs, "Jon") }, "Username contains invalid characters."},
+		{"email", nil, func(r *Rules, errs FieldErrors) { r.CheckEmail(errs, "username", "jon@example.com") }, ""},
+		{"email missing", nil, func(r *Rules, errs FieldErrors) { r.CheckEmail(errs, "username", "") }, "Email is required."},
+		{"email invalid", nil, func(r *Rules, errs FieldErrors) { r.CheckEmail(errs, "username", "jon@example") }, "Email is not a valid address."},
+		{"password", nil, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "secret12") }, ""},
+		{"password missing", nil, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "") }, "Password is required."},
+		{"password short", nil, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "abc12") }, "Password must be at least 8 characters."},
+		{"password counts runes", map[string]string{"password_min": "4", "password_classes": "1"}, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "ééé") }, "Password must be at least 4 characters."},
+		{"password classes", nil, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "abcdefgh") }, "Password must mix at least 2 of lowercase, uppercase, digits and symbols."},
+		{"password more classes", map[string]string{"password_classes": "3"}, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "Abcdefgh") }, "Password must mix at least 3 of lowercase, uppercase, digits and symbols."},
+		{"hashed password", map[string]string{"hashed_passwords": "true"}, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", digest) }, ""},
+		{"hashed password sent plain", map[string]string{"hashed_passwords": "true"}, func(r *Rules, errs FieldErrors) { r.CheckPassword(errs, "username", "Secret password 1") }, "Password must be hashed by the client."},
+	}
+	for _, test := range tests {
+		rules, err := NewRules(test.params)
+		mustStore(t, err)
+		errs := make(FieldErrors)
+		test.check(rules, errs)
+		if errs["username"] != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, errs["username"], test.want)
+		}
+	}
+}
+
+func TestNewRulesRejectsBadValues(t *testing.T) {
+	for _, params := range []map[string]string{
+		{"username_min": "three"},
+		{"password_classes": ""},
+		{"username_pattern": "["},
+		{"email_pattern": "(("},
+	} {
+		if _, err := NewRules(params); err == nil {
+			t.Errorf("NewRules(%v) accepted them", params)
+		}
+	}
+}
+
+// TestRegisterErrors checks the status and field errors RegisterHandler
+// answers with.
+func TestRegisterErrors(t *testing.T) {
+	a := accountApp(t, authPassword, false)
+	tests := []struct {
+		name   string
+		form   url.Values
+		code   int
+		fields []string
+	}{
+		{"invalid", url.Values{"username": {"j"}, "email": {"nope"}, "password": {"short"}}, 400, []string{"username", "email", "password"}},
+		{"taken", url.Values{"username": {"jon"}, "email": {"jon@example.org"}, "password": {authPassword}}, 409, []string{"username"}},
+		{"registered", url.Values{"username": {"ann"}, "email": {"ann@example.com"}, "password": {authPassword}}, 200, nil},
+	}
+	for _, test := range tests {
+		w := postForm(a.RegisterHandler, "/register", test.form)
+		if w.Code != test.code {
+			t.Errorf("%s: answered %d, want %d", test.name, w.Code, test.code)
+			continue
+		}
+		if test.code == 200 {
+			continue
+		}
+		res := &ErrorResponse{}
+		mustStore(t, json.Unmarshal(w.Body.Bytes(), res))
+		for _, field := range test.fields {
+			if res.Fields[field] == "" {
+				t.Errorf("%s: no error for %s in %+v", test.name, field, res)
+			}
+		}
+	}
+	if _, err := a.Authenticate(context.Background(), "ann", authPassword); err != nil {
+		t.Fatalf("the registered user cannot log in: %s", err)
+	}
+}